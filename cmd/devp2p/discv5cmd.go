@@ -18,6 +18,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -168,6 +169,7 @@ func discv5Listen(ctx *cli.Context) error {
 	api := &discAPI{
 		host:          disc,
 		searchTimeout: defaultSearchTimeout,
+		registered:    make(map[topicindex.TopicID]struct{}),
 	}
 	if extConfig != nil && extConfig.SearchTimeoutSeconds > 0 {
 		api.searchTimeout = time.Duration(extConfig.SearchTimeoutSeconds) * time.Second
@@ -175,6 +177,7 @@ func discv5Listen(ctx *cli.Context) error {
 	log.Info("Starting RPC API server", "addr", httpAddr)
 	srv := rpc.NewServer()
 	srv.RegisterName("discv5", api)
+	srv.RegisterName("debug", &discDebugAPI{host: disc})
 	http.DefaultServeMux.Handle("/", srv)
 	httpsrv := http.Server{Addr: httpAddr, Handler: http.DefaultServeMux}
 	return httpsrv.ListenAndServe()
@@ -186,11 +189,12 @@ func startV5(ctx *cli.Context, extConfig *discv5NodeConfig) *discover.UDPv5 {
 	if extConfig != nil {
 		config.PingInterval = time.Duration(extConfig.PingInterval) * time.Second
 		config.RefreshInterval = time.Duration(extConfig.BucketRefreshInterval) * time.Second
+		config.Topic.K = extConfig.K
 		config.Topic.AdCacheSize = extConfig.AdCacheSize
 		config.Topic.AdLifetime = time.Duration(extConfig.AdLifetimeSeconds) * time.Second
 		config.Topic.RegBucketSize = extConfig.RegBucketSize
 		config.Topic.RegBucketStandbyLimit = extConfig.RegBucketStandbySize
-		config.Topic.RegAttemptTimeout = time.Duration(extConfig.RegTimeoutSeconds) * time.Second
+		config.Topic.RegMaxWaitTime = time.Duration(extConfig.RegTimeoutSeconds) * time.Second
 		config.Topic.SearchBucketSize = extConfig.SearchBucketSize
 	}
 
@@ -213,6 +217,7 @@ type discv5NodeConfig struct {
 	BucketRefreshInterval int `json:"bucketRefreshInterval"`
 
 	// Topic system config:
+	K                    int `json:"k"`
 	AdCacheSize          int `json:"adCacheSize"`
 	AdLifetimeSeconds    int `json:"adLifetimeSeconds"`
 	RegBucketSize        int `json:"regBucketSize"`
@@ -243,18 +248,44 @@ func loadConfig(file string) (*discv5NodeConfig, error) {
 type discAPI struct {
 	host          *discover.UDPv5
 	searchTimeout time.Duration
+
+	// registered tracks the topics registered through RPC. UDPv5 registrations
+	// are reference-counted, but RegisterTopic and UnregisterTopic are not: the
+	// RPC layer holds at most one reference per topic.
+	mu         sync.Mutex
+	registered map[topicindex.TopicID]struct{}
 }
 
+// RegisterTopic starts registration of a topic. Registering a topic which is
+// already registered does nothing.
 func (api *discAPI) RegisterTopic(topic common.Hash, opID *uint64) {
 	var op uint64
 	if opID != nil {
 		op = *opID
 	}
-	api.host.RegisterTopic(topicindex.TopicID(topic), op)
+	id := topicindex.TopicID(topic)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if _, ok := api.registered[id]; ok {
+		return
+	}
+	api.registered[id] = struct{}{}
+	api.host.RegisterTopic(id, op)
 }
 
+// UnregisterTopic stops registration of a topic. A single call undoes any number
+// of RegisterTopic calls for the topic.
 func (api *discAPI) UnregisterTopic(topic common.Hash) {
-	api.host.StopRegisterTopic(topicindex.TopicID(topic))
+	id := topicindex.TopicID(topic)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if _, ok := api.registered[id]; !ok {
+		return
+	}
+	delete(api.registered, id)
+	api.host.StopRegisterTopic(id)
 }
 
 func (api *discAPI) NodeTable() []*enode.Node {
@@ -313,3 +344,17 @@ func (api *discAPI) TopicSearch(topic common.Hash, numNodes int, opID *uint64) [
 func (api *discAPI) LocalNode() *enode.Node {
 	return api.host.Self()
 }
+
+// discDebugAPI provides diagnostic RPC methods.
+type discDebugAPI struct {
+	host *discover.UDPv5
+}
+
+// TopicRegSnapshot returns the registration table of a topic.
+func (api *discDebugAPI) TopicRegSnapshot(topic common.Hash) ([]topicindex.RegBucketInfo, error) {
+	snap, ok := api.host.TopicRegistrationSnapshot(topicindex.TopicID(topic))
+	if !ok {
+		return nil, errors.New("topic is not being registered")
+	}
+	return snap, nil
+}
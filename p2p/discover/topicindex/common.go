@@ -18,16 +18,40 @@ package topicindex
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"golang.org/x/time/rate"
 )
 
+// minSearchIteratorBufferSize is the lower bound of Config.SearchIteratorBufferSize.
+const minSearchIteratorBufferSize = 16
+
 // Config is the configuration of the topic system.
 type Config struct {
-	Self enode.ID // the node's own ID
+	Self enode.ID // the node's own ID, the zero ID means unset
+
+	// ExcludeIDs lists nodes which are never used as registrars or search targets,
+	// for example bootstrap nodes which don't support topic discovery.
+	ExcludeIDs []enode.ID
+
+	// RegSeedNodes and SearchSeedNodes are added to every new Registration and
+	// Search, for example well-known registrars of a topic. They are added even
+	// when their bucket is full.
+	RegSeedNodes    []*enode.Node
+	SearchSeedNodes []*enode.Node
+
+	// K is the bucket size of the underlying Kademlia table. When set, it is the
+	// default for RegBucketSize and SearchBucketSize. When unset, those default to
+	// 10 and 8.
+	K int
 
 	// Topic table settings.
 	AdLifetime  time.Duration
@@ -36,39 +60,235 @@ type Config struct {
 	// Registration settings.
 	RegBucketSize         int           // max/ number of active nodes in registration bucket
 	RegBucketStandbyLimit int           // max. number of 'standby' state nodes in bucket
-	RegAttemptTimeout     time.Duration // maximum amount of time to wait on one attempt
+	RegBucketTotalCap     int           // max. number of nodes in bucket, in any state
+	RegMaxWaitTime        time.Duration // max. total ticket waiting time for one attempt
+	RegAttemptTimeout     time.Duration // Deprecated: use RegMaxWaitTime
+	RegConcurrency        int           // max. number of in-flight registration requests
+	RegRequestQueueSize   int           // max. number of started requests waiting for dispatch
+	RegMaxRetries         int           // max. number of retries after failed requests to a registrar
+	RegMaxAttempts        int           // max. number of requests to a registrar issuing tickets
+	RegMaxBackoff         time.Duration // max. delay before retrying a failed request
+	RegInitialJitter      time.Duration // max. random delay of first request to a registrar, negative disables
+	RegPromoteRandomly    bool          // promote arbitrary standby nodes instead of the closest one
+	RegDefaultTTL         time.Duration // ad lifetime assumed when registrar doesn't announce one
+	RegBlacklistTTL       time.Duration // how long a removed registrar is ignored
+	RegMaxSameSubnet      int           // max. number of registered registrars in one /24 IPv4 subnet
+
+	// RegLookupInterval is the minimum time between refreshes of the registration
+	// table from the local node table. The actual interval is randomized by up to
+	// RegLookupIntervalJitter in either direction.
+	RegLookupInterval       time.Duration
+	RegLookupIntervalJitter time.Duration
+
+	// While there are fewer than RegMinRegistrations registrations, the table is
+	// refreshed every RegFastLookupInterval instead. While the table is saturated,
+	// the interval doubles on every refresh, up to RegLookupMaxInterval. It goes
+	// back to RegLookupInterval when a registration expires.
+	RegMinRegistrations   int
+	RegFastLookupInterval time.Duration
+	RegLookupMaxInterval  time.Duration
 
 	// Search settings.
-	SearchBucketSize int // number of nodes in search buckets
+	SearchBucketSize      int           // number of nodes in search buckets
+	SearchMaxResults      int           // search is done after finding this many results
+	SearchMinResults      int           // search isn't done before finding this many results
+	SearchMaxEmptyRounds  int           // search is done after this many rounds without new nodes
+	SearchMinLookupRounds int           // search isn't done for lack of new nodes before this many rounds
+	SearchQueryTimeout    time.Duration // max. duration of a single TOPICQUERY request
+	SearchQueryMinDelay   time.Duration // min. time between two batches of TOPICQUERY requests
+	SearchQueryBatchSize  int           // number of TOPICQUERY requests sent concurrently
+	SearchLookupMinDelay  time.Duration // min. time between search rounds, negative disables
+	SearchBucketResultCap int           // max. number of results accepted from nodes in one bucket
+	SearchMaxBucketDepth  int           // number of closest non-empty buckets used for queries
+	SearchBucketOrder     SearchBucketOrder
+	SearchColdStart       bool // don't add nodes asked in the previous round when a search restarts
+	SearchClosestQuery    bool // query the closest node in bucket order instead of sampling by distance
+	SearchWarmUpFindnode  bool // request the node's record with FINDNODE before every TOPICQUERY
+	SearchAuditLog        bool // log every received query result at trace level
+
+	SearchDedupeWindowSize   int // number of result IDs remembered for deduplication
+	SearchIteratorBufferSize int // number of results buffered for the search iterator
+	SearchMaxPersistedAsked  int // max. number of asked node IDs stored by MarshalAskedSet
+
+	// TopicRateLimit, if set, limits the rate of outgoing registration and
+	// search requests. The limiter is shared by all topics.
+	TopicRateLimit *rate.Limiter
+
+	// Metrics, if set, collects statistics about registration and search.
+	Metrics *Metrics
+
+	// SearchResultCallback, if set, receives search results instead of the search
+	// iterator. It is called on up to CallbackWorkers goroutines concurrently, and
+	// is not called anymore after the search has stopped.
+	SearchResultCallback func(topic TopicID, node *enode.Node)
+	CallbackWorkers      int
+
+	// OnRegistered and OnExpired, if set, are called when a registrar accepts an ad
+	// and when the ad expires. They run on the registration loop and must not block.
+	OnRegistered func(topic TopicID, registrar *enode.Node, expiry mclock.AbsTime)
+	OnExpired    func(topic TopicID, registrar *enode.Node)
 
 	// These settings are exposed for testing purposes.
 	Clock mclock.Clock
 	Log   log.Logger
+
+	// JitterRand is the random source for RegInitialJitter, RegPromoteRandomly and
+	// the retry backoff jitter. When nil, each Registration uses a source seeded
+	// from Self and the topic. It must not be shared between registrations running
+	// on different goroutines.
+	JitterRand *rand.Rand
+}
+
+// SearchBucketOrder determines which search buckets are queried first.
+type SearchBucketOrder int
+
+const (
+	// SearchCloseFirst queries nodes closest to the topic first. They are the most
+	// likely to hold ads.
+	SearchCloseFirst SearchBucketOrder = iota
+	// SearchFarFirst queries nodes farthest from the topic first.
+	SearchFarFirst
+)
+
+// DefaultConfig returns a config with all options set to their defaults.
+func DefaultConfig() Config {
+	return Config{}.WithDefaults()
 }
 
-// withDefaults configures defaults for unset config options.
-func (cfg Config) withDefaults() Config {
+// Clone returns a copy of the config. The ExcludeIDs and seed node lists are
+// copied. Other reference-type options like Metrics and TopicRateLimit are shared
+// with cfg.
+func (cfg Config) Clone() Config {
+	if cfg.ExcludeIDs != nil {
+		cfg.ExcludeIDs = append([]enode.ID{}, cfg.ExcludeIDs...)
+	}
+	if cfg.RegSeedNodes != nil {
+		cfg.RegSeedNodes = append([]*enode.Node{}, cfg.RegSeedNodes...)
+	}
+	if cfg.SearchSeedNodes != nil {
+		cfg.SearchSeedNodes = append([]*enode.Node{}, cfg.SearchSeedNodes...)
+	}
+	return cfg
+}
+
+// WithDefaults configures defaults for unset config options.
+func (cfg Config) WithDefaults() Config {
 	if cfg.AdLifetime == 0 {
 		cfg.AdLifetime = 15 * time.Minute
 	}
 	if cfg.AdCacheSize == 0 {
 		cfg.AdCacheSize = 5000
 	}
-	if cfg.RegAttemptTimeout == 0 {
-		// Note: RegAttemptTimeout == AdLifetime is a good choice because, when AdLifetime
-		// has passed, all ads will have cycled in the remote table. If registration still
-		// hasn't worked after this time, the registrar is overloaded or malfunctioning
-		// and it's better to pick another one.
-		cfg.RegAttemptTimeout = cfg.AdLifetime + cfg.AdLifetime/2
+	if cfg.RegMaxWaitTime == 0 {
+		// Note: RegMaxWaitTime should be slightly above AdLifetime because, when
+		// AdLifetime has passed, all ads will have cycled in the remote table. If
+		// registration still hasn't worked after this time, the registrar is overloaded
+		// or malfunctioning and it's better to pick another one.
+		cfg.RegMaxWaitTime = cfg.AdLifetime + cfg.AdLifetime/2
+		if cfg.RegAttemptTimeout != 0 {
+			cfg.RegMaxWaitTime = cfg.RegAttemptTimeout
+		}
 	}
 	if cfg.RegBucketSize == 0 {
 		cfg.RegBucketSize = 10
+		if cfg.K > 0 {
+			cfg.RegBucketSize = cfg.K
+		}
 	}
 	if cfg.RegBucketStandbyLimit == 0 {
 		cfg.RegBucketStandbyLimit = 20
 	}
+	if cfg.RegBucketTotalCap == 0 {
+		cfg.RegBucketTotalCap = cfg.RegBucketSize + cfg.RegBucketStandbyLimit
+	}
+	if cfg.RegConcurrency == 0 {
+		cfg.RegConcurrency = 8
+	}
+	if cfg.RegRequestQueueSize == 0 {
+		cfg.RegRequestQueueSize = 4
+	}
+	if cfg.RegMaxRetries == 0 {
+		cfg.RegMaxRetries = 3
+	}
+	if cfg.RegMaxAttempts == 0 {
+		cfg.RegMaxAttempts = 10
+	}
+	if cfg.RegDefaultTTL == 0 {
+		cfg.RegDefaultTTL = 10 * time.Minute
+	}
+	if cfg.RegBlacklistTTL == 0 {
+		cfg.RegBlacklistTTL = 10 * time.Minute
+	}
+	if cfg.RegMaxSameSubnet == 0 {
+		cfg.RegMaxSameSubnet = 2
+	}
+	if cfg.RegInitialJitter == 0 {
+		cfg.RegInitialJitter = 500 * time.Millisecond
+	}
+	if cfg.RegLookupInterval == 0 {
+		cfg.RegLookupInterval = 2 * time.Second
+	}
+	if cfg.RegLookupIntervalJitter == 0 {
+		cfg.RegLookupIntervalJitter = 200 * time.Millisecond
+	}
+	if cfg.RegMinRegistrations == 0 {
+		cfg.RegMinRegistrations = 10
+	}
+	if cfg.RegFastLookupInterval == 0 {
+		cfg.RegFastLookupInterval = 500 * time.Millisecond
+	}
+	if cfg.RegLookupMaxInterval == 0 {
+		cfg.RegLookupMaxInterval = 5 * time.Minute
+	}
+	if cfg.RegMaxBackoff == 0 {
+		cfg.RegMaxBackoff = 5 * time.Minute
+	}
 	if cfg.SearchBucketSize == 0 {
 		cfg.SearchBucketSize = 8
+		if cfg.K > 0 {
+			cfg.SearchBucketSize = cfg.K
+		}
+	}
+	if cfg.SearchMaxResults == 0 {
+		cfg.SearchMaxResults = 200
+	}
+	if cfg.SearchMaxEmptyRounds == 0 {
+		cfg.SearchMaxEmptyRounds = 2
+	}
+	if cfg.SearchMinLookupRounds == 0 {
+		cfg.SearchMinLookupRounds = 5
+	}
+	if cfg.SearchBucketResultCap == 0 {
+		cfg.SearchBucketResultCap = 50
+	}
+	if cfg.SearchMaxBucketDepth == 0 {
+		cfg.SearchMaxBucketDepth = 10
+	}
+	if cfg.SearchQueryMinDelay == 0 {
+		cfg.SearchQueryMinDelay = 500 * time.Millisecond
+	}
+	if cfg.SearchLookupMinDelay == 0 {
+		cfg.SearchLookupMinDelay = 2 * time.Second
+	}
+	if cfg.SearchQueryTimeout == 0 {
+		cfg.SearchQueryTimeout = 5 * time.Second
+	}
+	if cfg.SearchQueryBatchSize == 0 {
+		cfg.SearchQueryBatchSize = 4
+	}
+	if cfg.SearchDedupeWindowSize == 0 {
+		cfg.SearchDedupeWindowSize = 1000
+	}
+	if cfg.SearchMaxPersistedAsked == 0 {
+		cfg.SearchMaxPersistedAsked = 500
+	}
+	if cfg.CallbackWorkers == 0 {
+		cfg.CallbackWorkers = 2
+	}
+	if cfg.SearchIteratorBufferSize == 0 {
+		cfg.SearchIteratorBufferSize = 200
+	} else if cfg.SearchIteratorBufferSize < minSearchIteratorBufferSize {
+		cfg.SearchIteratorBufferSize = minSearchIteratorBufferSize
 	}
 
 	if cfg.Log == nil {
@@ -80,17 +300,142 @@ func (cfg Config) withDefaults() Config {
 	return cfg
 }
 
+// isSelf reports whether id is the local node. It is always false when Self is unset.
+func (cfg *Config) isSelf(id enode.ID) bool {
+	return cfg.Self != (enode.ID{}) && id == cfg.Self
+}
+
+// isExcluded reports whether the node with the given ID must not be used for
+// registration or search.
+func (cfg *Config) isExcluded(id enode.ID) bool {
+	if cfg.isSelf(id) {
+		return true
+	}
+	for _, x := range cfg.ExcludeIDs {
+		if id == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the config for invalid settings. Note that unset options are
+// reported as errors, so Validate should be called on the result of WithDefaults.
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.K < 0:
+		return fmt.Errorf("invalid K %d", cfg.K)
+	case cfg.AdLifetime <= 0:
+		return fmt.Errorf("invalid AdLifetime %v", cfg.AdLifetime)
+	case cfg.AdCacheSize <= 0:
+		return fmt.Errorf("invalid AdCacheSize %d", cfg.AdCacheSize)
+	case cfg.RegBucketSize <= 0:
+		return fmt.Errorf("invalid RegBucketSize %d", cfg.RegBucketSize)
+	case cfg.RegBucketStandbyLimit <= 0:
+		return fmt.Errorf("invalid RegBucketStandbyLimit %d", cfg.RegBucketStandbyLimit)
+	case cfg.RegBucketTotalCap <= 0:
+		return fmt.Errorf("invalid RegBucketTotalCap %d", cfg.RegBucketTotalCap)
+	case cfg.RegConcurrency <= 0:
+		return fmt.Errorf("invalid RegConcurrency %d", cfg.RegConcurrency)
+	case cfg.RegRequestQueueSize <= 0:
+		return fmt.Errorf("invalid RegRequestQueueSize %d", cfg.RegRequestQueueSize)
+	case cfg.RegDefaultTTL <= 0:
+		return fmt.Errorf("invalid RegDefaultTTL %v", cfg.RegDefaultTTL)
+	case cfg.RegMaxSameSubnet <= 0:
+		return fmt.Errorf("invalid RegMaxSameSubnet %d", cfg.RegMaxSameSubnet)
+	case cfg.SearchBucketSize <= 0:
+		return fmt.Errorf("invalid SearchBucketSize %d", cfg.SearchBucketSize)
+	case cfg.SearchMaxResults <= 0:
+		return fmt.Errorf("invalid SearchMaxResults %d", cfg.SearchMaxResults)
+	case cfg.SearchMinResults < 0 || cfg.SearchMinResults > cfg.SearchMaxResults:
+		return fmt.Errorf("invalid SearchMinResults %d", cfg.SearchMinResults)
+	case cfg.SearchMinLookupRounds <= 0:
+		return fmt.Errorf("invalid SearchMinLookupRounds %d", cfg.SearchMinLookupRounds)
+	case cfg.SearchQueryBatchSize <= 0:
+		return fmt.Errorf("invalid SearchQueryBatchSize %d", cfg.SearchQueryBatchSize)
+	case cfg.SearchMaxBucketDepth <= 0:
+		return fmt.Errorf("invalid SearchMaxBucketDepth %d", cfg.SearchMaxBucketDepth)
+	case cfg.SearchBucketOrder != SearchCloseFirst && cfg.SearchBucketOrder != SearchFarFirst:
+		return fmt.Errorf("invalid SearchBucketOrder %d", cfg.SearchBucketOrder)
+	case cfg.SearchDedupeWindowSize <= 0:
+		return fmt.Errorf("invalid SearchDedupeWindowSize %d", cfg.SearchDedupeWindowSize)
+	case cfg.SearchMaxPersistedAsked <= 0:
+		return fmt.Errorf("invalid SearchMaxPersistedAsked %d", cfg.SearchMaxPersistedAsked)
+	case cfg.CallbackWorkers <= 0:
+		return fmt.Errorf("invalid CallbackWorkers %d", cfg.CallbackWorkers)
+	case cfg.Clock == nil:
+		return errors.New("Clock is nil")
+	case cfg.Log == nil:
+		return errors.New("Log is nil")
+	}
+	return nil
+}
+
 // TopicID represents a topic.
 type TopicID [32]byte
 
+// TopicFromString returns the topic ID of a human-readable topic name.
+// The ID is the Keccak256 hash of the UTF-8 encoded name.
+func TopicFromString(s string) TopicID {
+	return TopicFromBytes([]byte(s))
+}
+
+// TopicFromBytes returns the topic ID of a binary topic name.
+// The ID is the Keccak256 hash of b.
+func TopicFromBytes(b []byte) TopicID {
+	return TopicID(crypto.Keccak256Hash(b))
+}
+
+// ParseTopic decodes a topic ID in hex encoding, as returned by Hex. The input
+// may have a 0x prefix.
+func ParseTopic(hex string) (TopicID, error) {
+	var t TopicID
+	err := t.UnmarshalText([]byte(hex))
+	return t, err
+}
+
+// TerminalString returns a shortened hex string for terminal logging.
 func (t TopicID) TerminalString() string {
 	return hex.EncodeToString(t[:8])
 }
 
+// String returns the first eight bytes of the topic in hex.
 func (t TopicID) String() string {
+	return hex.EncodeToString(t[:8]) + "..."
+}
+
+// Hex returns the topic as a 64-character hex string.
+func (t TopicID) Hex() string {
 	return hex.EncodeToString(t[:])
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (t TopicID) MarshalText() ([]byte, error) {
+	return []byte(t.Hex()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. The input may have a 0x prefix.
+func (t *TopicID) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(strings.TrimPrefix(string(text), "0x"))
+	if err != nil {
+		return err
+	}
+	if len(b) != len(t) {
+		return fmt.Errorf("wrong topic length, want %d hex chars", len(t)*2)
+	}
+	copy(t[:], b)
+	return nil
+}
+
 // Never is a special time value returned by certain event-scheduling functions.
 // It indicates that the event should not be scheduled.
+//
+// Since mclock.AbsTime is signed, Never is negative and lies in the past. Passing it
+// to mclock.Alarm.Schedule makes the alarm fire immediately, so it must be checked
+// using IsNever first.
 const Never = ^mclock.AbsTime(0)
+
+// IsNever reports whether t is Never.
+func IsNever(t mclock.AbsTime) bool {
+	return t == Never
+}
@@ -0,0 +1,300 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/internal/testlog"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (Config{}).Validate(); err == nil {
+		t.Fatal("zero Config is valid")
+	}
+	if err := (Config{}).WithDefaults().Validate(); err != nil {
+		t.Fatal("default Config is invalid:", err)
+	}
+
+	// Check that clearing each required field is caught.
+	fields := map[string]func(*Config){
+		"AdLifetime":              func(c *Config) { c.AdLifetime = 0 },
+		"AdCacheSize":             func(c *Config) { c.AdCacheSize = 0 },
+		"RegBucketSize":           func(c *Config) { c.RegBucketSize = 0 },
+		"RegBucketStandbyLimit":   func(c *Config) { c.RegBucketStandbyLimit = 0 },
+		"RegBucketTotalCap":       func(c *Config) { c.RegBucketTotalCap = 0 },
+		"RegConcurrency":          func(c *Config) { c.RegConcurrency = 0 },
+		"RegRequestQueueSize":     func(c *Config) { c.RegRequestQueueSize = 0 },
+		"RegDefaultTTL":           func(c *Config) { c.RegDefaultTTL = 0 },
+		"SearchBucketSize":        func(c *Config) { c.SearchBucketSize = 0 },
+		"SearchMaxResults":        func(c *Config) { c.SearchMaxResults = 0 },
+		"SearchMinLookupRounds":   func(c *Config) { c.SearchMinLookupRounds = 0 },
+		"SearchDedupeWindowSize":  func(c *Config) { c.SearchDedupeWindowSize = 0 },
+		"SearchMaxPersistedAsked": func(c *Config) { c.SearchMaxPersistedAsked = 0 },
+		"SearchQueryBatchSize":    func(c *Config) { c.SearchQueryBatchSize = 0 },
+		"SearchMaxBucketDepth":    func(c *Config) { c.SearchMaxBucketDepth = 0 },
+		"CallbackWorkers":         func(c *Config) { c.CallbackWorkers = 0 },
+		"Clock":                   func(c *Config) { c.Clock = nil },
+		"Log":                     func(c *Config) { c.Log = nil },
+	}
+	for name, clear := range fields {
+		cfg := Config{}.WithDefaults()
+		clear(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("unset %s not detected", name)
+		}
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("DefaultConfig is invalid:", err)
+	}
+	if _, ok := cfg.Clock.(mclock.System); !ok {
+		t.Fatalf("wrong default clock %T", cfg.Clock)
+	}
+	if !reflect.DeepEqual(cfg, (Config{}).WithDefaults()) {
+		t.Fatal("DefaultConfig differs from WithDefaults")
+	}
+}
+
+// This test checks that K is the default bucket size for registration and search,
+// that explicitly configured sizes are kept, and that the sizes keep their own
+// defaults when K is unset.
+func TestConfigK(t *testing.T) {
+	cfg := Config{K: 20}.WithDefaults()
+	if cfg.RegBucketSize != 20 || cfg.SearchBucketSize != 20 {
+		t.Fatalf("wrong bucket sizes %d, %d for K = 20", cfg.RegBucketSize, cfg.SearchBucketSize)
+	}
+	if cfg.RegBucketTotalCap != 20+cfg.RegBucketStandbyLimit {
+		t.Fatalf("wrong RegBucketTotalCap %d", cfg.RegBucketTotalCap)
+	}
+
+	cfg = Config{K: 20, RegBucketSize: 5, SearchBucketSize: 7}.WithDefaults()
+	if cfg.RegBucketSize != 5 || cfg.SearchBucketSize != 7 {
+		t.Fatalf("explicit bucket sizes overridden: %d, %d", cfg.RegBucketSize, cfg.SearchBucketSize)
+	}
+
+	cfg = DefaultConfig()
+	if cfg.K != 0 || cfg.RegBucketSize != 10 || cfg.SearchBucketSize != 8 {
+		t.Fatalf("wrong default sizes K=%d reg=%d search=%d", cfg.K, cfg.RegBucketSize, cfg.SearchBucketSize)
+	}
+}
+
+// This test checks the RegMaxWaitTime default and that the deprecated
+// RegAttemptTimeout is still applied.
+func TestConfigRegMaxWaitTime(t *testing.T) {
+	cfg := DefaultConfig()
+	if cfg.RegMaxWaitTime != 22*time.Minute+30*time.Second {
+		t.Fatalf("wrong default RegMaxWaitTime %v", cfg.RegMaxWaitTime)
+	}
+	if cfg.RegMaxWaitTime <= cfg.AdLifetime {
+		t.Fatalf("default RegMaxWaitTime %v not above AdLifetime %v", cfg.RegMaxWaitTime, cfg.AdLifetime)
+	}
+
+	cfg = Config{RegAttemptTimeout: 5 * time.Minute}.WithDefaults()
+	if cfg.RegMaxWaitTime != 5*time.Minute {
+		t.Fatalf("RegAttemptTimeout not applied: RegMaxWaitTime = %v", cfg.RegMaxWaitTime)
+	}
+	cfg = Config{RegAttemptTimeout: 5 * time.Minute, RegMaxWaitTime: 7 * time.Minute}.WithDefaults()
+	if cfg.RegMaxWaitTime != 7*time.Minute {
+		t.Fatalf("RegAttemptTimeout overrides RegMaxWaitTime: %v", cfg.RegMaxWaitTime)
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ExcludeIDs = []enode.ID{{1}}
+	cfg.RegSeedNodes = []*enode.Node{newNode()}
+	cfg.SearchSeedNodes = []*enode.Node{newNode()}
+	var (
+		regSeed    = cfg.RegSeedNodes[0]
+		searchSeed = cfg.SearchSeedNodes[0]
+	)
+	clone := cfg.Clone()
+	clone.ExcludeIDs[0] = enode.ID{2}
+	clone.RegSeedNodes[0] = nil
+	clone.SearchSeedNodes[0] = nil
+	clone.RegBucketSize++
+	if cfg.ExcludeIDs[0] != (enode.ID{1}) {
+		t.Fatal("modifying clone changed ExcludeIDs of original")
+	}
+	if cfg.RegSeedNodes[0] != regSeed || cfg.SearchSeedNodes[0] != searchSeed {
+		t.Fatal("modifying clone changed seed nodes of original")
+	}
+	if cfg.RegBucketSize == clone.RegBucketSize {
+		t.Fatal("modifying clone changed original")
+	}
+}
+
+func TestConfigValidateConstructor(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewSearch did not panic for invalid config")
+		}
+	}()
+	NewSearch(topic1, Config{SearchBucketSize: -1})
+}
+
+// This test checks that the constructors work with a zero Config.
+func TestZeroConfig(t *testing.T) {
+	n := enode.SignNull(new(enr.Record), enode.ID{1})
+
+	r := NewRegistration(topic1, Config{})
+	r.AddNodes(nil, []*enode.Node{n})
+	if r.NodeCount() != 1 || r.ActiveLen() != 1 {
+		t.Error("Registration with zero config has no attempt")
+	}
+
+	s := NewSearch(topic1, Config{})
+	s.AddNodes(nil, []*enode.Node{n})
+	if s.QueryTarget() != n {
+		t.Error("Search with zero config has no query target")
+	}
+
+	tab := NewTopicTable(enode.ID{2}, Config{})
+	if tab.AdLifetime() <= 0 {
+		t.Error("TopicTable with zero config has no ad lifetime")
+	}
+}
+
+func TestTopicIDText(t *testing.T) {
+	topic := TopicID{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5}
+	if s := topic.String(); s != "deadbeef01020304..." {
+		t.Errorf("wrong String: %s", s)
+	}
+	if h := topic.Hex(); len(h) != 64 || !strings.HasPrefix(h, "deadbeef0102030405") {
+		t.Errorf("wrong Hex: %s", h)
+	}
+
+	enc, err := json.Marshal(map[string]TopicID{"topic": topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec map[string]TopicID
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		t.Fatal(err)
+	}
+	if dec["topic"] != topic {
+		t.Fatalf("round trip failed: got %x, want %x", dec["topic"], topic)
+	}
+
+	var prefixed TopicID
+	if err := prefixed.UnmarshalText([]byte("0x" + topic.Hex())); err != nil || prefixed != topic {
+		t.Fatalf("can't decode 0x-prefixed topic: %v", err)
+	}
+	for _, bad := range []string{"", "dead", topic.Hex() + "00", "zz" + topic.Hex()[2:]} {
+		var tid TopicID
+		if err := tid.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("no error for invalid input %q", bad)
+		}
+	}
+}
+
+func TestTopicConstructors(t *testing.T) {
+	name := "my-topic"
+	topic := TopicFromString(name)
+	if want := TopicID(crypto.Keccak256Hash([]byte(name))); topic != want {
+		t.Fatalf("TopicFromString(%q) = %x, want %x", name, topic, want)
+	}
+	if b := TopicFromBytes([]byte(name)); b != topic {
+		t.Fatalf("TopicFromBytes and TopicFromString differ: %x != %x", b, topic)
+	}
+	if TopicFromString("other-topic") == topic {
+		t.Fatal("different names have the same topic ID")
+	}
+
+	for _, input := range []string{topic.Hex(), "0x" + topic.Hex()} {
+		parsed, err := ParseTopic(input)
+		if err != nil {
+			t.Fatalf("ParseTopic(%q) failed: %v", input, err)
+		}
+		if parsed != topic {
+			t.Fatalf("ParseTopic(%q) = %x, want %x", input, parsed, topic)
+		}
+	}
+	if _, err := ParseTopic("dead"); err == nil {
+		t.Fatal("ParseTopic accepted short input")
+	}
+}
+
+func TestConfigExcludedNodes(t *testing.T) {
+	var (
+		zero  = enode.SignNull(new(enr.Record), enode.ID{})
+		self  = enode.SignNull(new(enr.Record), enode.ID{1})
+		boot  = enode.SignNull(new(enr.Record), enode.ID{2})
+		other = enode.SignNull(new(enr.Record), enode.ID{3})
+	)
+	tests := []struct {
+		name    string
+		cfg     Config
+		node    *enode.Node
+		exclude bool
+	}{
+		{"zero ID, Self unset", Config{}, zero, false},
+		{"zero ID, Self set", Config{Self: self.ID()}, zero, false},
+		{"Self", Config{Self: self.ID()}, self, true},
+		{"ExcludeIDs", Config{ExcludeIDs: []enode.ID{boot.ID()}}, boot, true},
+		{"not in ExcludeIDs", Config{Self: self.ID(), ExcludeIDs: []enode.ID{boot.ID()}}, other, false},
+	}
+	for _, test := range tests {
+		test.cfg.Log = testlog.Logger(t, log.LvlTrace)
+		test.cfg.RegInitialJitter = -1
+
+		r := NewRegistration(topic1, test.cfg)
+		r.AddNodes(nil, []*enode.Node{test.node})
+		if added := r.NodeCount() == 1; added == test.exclude {
+			t.Errorf("%s: Registration.AddNodes added=%t, want %t", test.name, added, !test.exclude)
+		}
+
+		s := NewSearch(topic1, test.cfg)
+		s.AddNodes(nil, []*enode.Node{test.node})
+		if added := s.Stats().Unasked == 1; added == test.exclude {
+			t.Errorf("%s: Search.AddNodes added=%t, want %t", test.name, added, !test.exclude)
+		}
+	}
+}
+
+// This test documents why Never must not be passed to mclock.Alarm.Schedule.
+func TestNeverAlarm(t *testing.T) {
+	if !IsNever(Never) || IsNever(0) {
+		t.Fatal("IsNever is wrong")
+	}
+
+	clock := new(mclock.Simulated)
+	clock.Run(time.Second)
+	alarm := mclock.NewAlarm(clock)
+	defer alarm.Stop()
+
+	alarm.Schedule(Never)
+	clock.Run(0)
+	select {
+	case <-alarm.C():
+	default:
+		t.Fatal("alarm scheduled at Never did not fire immediately")
+	}
+}
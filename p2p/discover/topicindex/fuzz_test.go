@@ -0,0 +1,190 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build go1.18
+// +build go1.18
+
+package topicindex
+
+import (
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var fuzzSelf = enode.HexID("0101010101010101010101010101010101010101010101010101010101010101")
+
+func FuzzRegistrationAddNodes(f *testing.F) {
+	for _, seed := range fuzzRegistrationSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		nodes := decodeFuzzNodes(data)
+		cfg := Config{Self: fuzzSelf, RegInitialJitter: -1, Log: log.New()}
+		cfg.Log.SetHandler(log.DiscardHandler())
+		r := NewRegistration(topic1, cfg)
+
+		// Add the nodes as table nodes and as nodes supplied by a registrar.
+		r.AddNodes(nil, nodes)
+		if len(nodes) > 0 {
+			r.AddNodes(nodes[0], nodes)
+		}
+		for i := range r.buckets {
+			if r.buckets[i].get(fuzzSelf) != nil {
+				t.Fatal("local node added to registration table")
+			}
+		}
+		for att := r.Update(); att != nil; att = r.Update() {
+			r.StartRequest(att)
+			r.HandleErrorResponse(att, errors.New("fuzz"))
+		}
+		r.Stats()
+	})
+}
+
+// decodeFuzzNodes decodes data as a list of node records. Records with the
+// "null" identity scheme are accepted, so the input can choose node IDs freely.
+func decodeFuzzNodes(data []byte) []*enode.Node {
+	var records []*enr.Record
+	if err := rlp.DecodeBytes(data, &records); err != nil {
+		return nil
+	}
+	var nodes []*enode.Node
+	for _, r := range records {
+		n, err := enode.New(enode.ValidSchemesForTesting, r)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func fuzzRegistrationSeeds() [][]byte {
+	node := func(id enode.ID, seq uint64, ip net.IP) *enr.Record {
+		var r enr.Record
+		r.SetSeq(seq)
+		if ip != nil {
+			r.Set(enr.IP(ip))
+		}
+		enode.SignNull(&r, id)
+		return &r
+	}
+	encode := func(records ...*enr.Record) []byte {
+		enc, err := rlp.EncodeToBytes(records)
+		if err != nil {
+			panic(err)
+		}
+		return enc
+	}
+	var (
+		id1 = enode.RandomID(enode.ID(topic1), 250)
+		id2 = enode.RandomID(enode.ID(topic1), 200)
+	)
+	return [][]byte{
+		nil,
+		{0xc0},
+		{0xff, 0x00, 0x01},
+		encode(node(fuzzSelf, 1, nil)),
+		encode(node(enode.ID{}, 0, nil)),
+		encode(node(enode.ID(topic1), 1, net.IP{8, 8, 8, 8})),
+		encode(node(id1, 0, nil), node(id1, math.MaxUint64, nil)),
+		encode(node(id1, math.MaxUint64, nil), node(id1, 0, nil)),
+		encode(node(id1, 1, net.IP{8, 8, 8, 8}), node(id2, 1, net.IP{8, 8, 8, 9})),
+		encode(node(id1, 1, net.IP{192, 168, 0, 1}), node(id2, 1, net.IP{10, 0, 0, 1})),
+		encode(node(id1, 1, net.ParseIP("2001:db8::1")), node(fuzzSelf, 2, nil), node(id2, 3, nil)),
+		encode(node(id2, 1, net.IP{0, 0, 0, 0})),
+	}
+}
+
+// FuzzRegistrationTransitions drives a registration through random sequences of
+// API calls. Any panic from a state transition check is a bug, since the calls
+// are all valid uses of the API.
+func FuzzRegistrationTransitions(f *testing.F) {
+	f.Add([]byte{0, 1, 3, 6, 1})
+	f.Add([]byte{0, 8, 16, 1, 1, 1, 3, 3, 11, 1, 2})
+	f.Add([]byte{0, 8, 1, 9, 4, 6, 1, 4, 6, 1, 4, 6, 1, 4})
+	f.Add([]byte{0, 1, 5, 3, 1, 2, 14, 1, 3, 6, 6, 1})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		clock := new(mclock.Simulated)
+		cfg := Config{
+			Clock:            clock,
+			RegBucketSize:    2,
+			RegMaxSameSubnet: 1,
+			RegMaxRetries:    2,
+			RegInitialJitter: -1,
+			Log:              log.New(),
+		}
+		cfg.Log.SetHandler(log.DiscardHandler())
+		r := NewRegistration(topic1, cfg)
+
+		// Nodes 0-3 share a /24 subnet, so limitSubnet demotes them.
+		var nodes []*enode.Node
+		for i := 0; i < 8; i++ {
+			ip := net.IP{8, 8, 8, byte(i)}
+			if i >= 4 {
+				ip = intIP(i)
+			}
+			nodes = append(nodes, nodeAtDistance(enode.ID(topic1), 250-i%3, ip))
+		}
+
+		var inflight []*RegAttempt
+		for _, op := range ops {
+			arg := int(op >> 3)
+			switch op % 8 {
+			case 0:
+				r.AddNodes(nil, nodes[arg%len(nodes):])
+			case 1:
+				if att := r.Update(); att != nil {
+					r.StartRequest(att)
+					inflight = append(inflight, att)
+				}
+			case 2, 3, 4:
+				if len(inflight) == 0 {
+					continue
+				}
+				i := arg % len(inflight)
+				att := inflight[i]
+				inflight = append(inflight[:i], inflight[i+1:]...)
+				switch op % 8 {
+				case 2:
+					r.HandleTicketResponse(att, []byte{1}, time.Duration(arg)*time.Second)
+				case 3:
+					r.HandleRegistered(att, time.Duration(arg+1)*time.Minute)
+				case 4:
+					r.HandleErrorResponse(att, errors.New("fuzz"))
+				}
+			case 5:
+				r.RemoveNode(nodes[arg%len(nodes)].ID())
+			case 6:
+				clock.Run(time.Duration(arg+1) * time.Minute)
+			case 7:
+				r.Stats()
+			}
+			if err := checkRegHeap(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
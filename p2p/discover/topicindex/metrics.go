@@ -0,0 +1,46 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// Metrics holds the meters of the topic system.
+type Metrics struct {
+	RegActive    metrics.Gauge   // number of topics being registered
+	RegSucceeded metrics.Counter // number of confirmed registrations
+	RegFailed    metrics.Counter // number of failed registration requests
+
+	SearchActive  metrics.Gauge   // number of running topic searches
+	SearchResults metrics.Counter // number of results delivered by searches
+	QueryLatency  metrics.Timer   // duration of TOPICQUERY requests
+}
+
+// NewDefaultMetrics creates metrics registered in the default registry.
+// All metric names are prefixed with namespace.
+func NewDefaultMetrics(namespace string) *Metrics {
+	r := metrics.DefaultRegistry
+	return &Metrics{
+		RegActive:     metrics.NewRegisteredGauge(namespace+"/reg/active", r),
+		RegSucceeded:  metrics.NewRegisteredCounter(namespace+"/reg/succeeded", r),
+		RegFailed:     metrics.NewRegisteredCounter(namespace+"/reg/failed", r),
+		SearchActive:  metrics.NewRegisteredGauge(namespace+"/search/active", r),
+		SearchResults: metrics.NewRegisteredCounter(namespace+"/search/results", r),
+		QueryLatency:  metrics.NewRegisteredTimer(namespace+"/search/querylatency", r),
+	}
+}
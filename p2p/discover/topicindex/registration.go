@@ -17,8 +17,13 @@
 package topicindex
 
 import (
+	"bytes"
 	"container/heap"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
@@ -37,6 +42,13 @@ const (
 	// Should there be any nodes which are closer than this, they just go into the last
 	// (closest) bucket.
 	regTableDepth = 40
+
+	// regMinBackoff is the delay before the first retry of a failed registration
+	// request. The delay doubles for every subsequent failure.
+	regMinBackoff = 5 * time.Second
+
+	// regRecentErrorsLimit is the number of errors kept for RegStats.
+	regRecentErrorsLimit = 10
 )
 
 // Registration is the state associated with registering in a single topic.
@@ -49,7 +61,10 @@ type Registration struct {
 	buckets [regTableDepth]regBucket
 	heap    regHeap
 
-	bucketCheck map[int]struct{}
+	bucketCheck  map[int]struct{}
+	denied       map[enode.ID]mclock.AbsTime // removed nodes, until expiry time
+	rand         *rand.Rand                  // for jitter and retry backoff
+	recentErrors []RegAttemptError
 }
 
 //go:generate go run golang.org/x/tools/cmd/stringer@latest -type RegAttemptState
@@ -58,13 +73,25 @@ type Registration struct {
 type RegAttemptState int
 
 type regBucket struct {
-	dist  int
-	att   map[enode.ID]*RegAttempt
-	count [nRegStates]int
+	dist   int
+	target enode.ID      // the topic
+	att    []*RegAttempt // sorted by distance to target
+	count  [nRegStates]int
+
+	// Statistics. These count promotions to Waiting, accepted registrations and
+	// failed requests since the bucket was created.
+	totalAttempted int
+	totalSucceeded int
+	totalFailed    int
 
 	ips netutil.DistinctNetSet
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (s RegAttemptState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 const (
 	Standby RegAttemptState = iota
 	Waiting
@@ -88,38 +115,84 @@ type RegAttempt struct {
 	// Node is the registrar node.
 	Node *enode.Node
 
+	// SourceID is the ID of the registrar which supplied Node. It is the zero ID
+	// when the node was found in the local node table.
+	SourceID enode.ID
+
 	// Ticket contains the ticket data returned by the last registration call.
 	Ticket []byte
 
-	// totalWaitTime is the time spent waiting so far.
+	// totalWaitTime is the sum of all waiting times issued by the registrar in
+	// tickets for this attempt. It is not reset when the node registers. When the
+	// attempt is removed, a new attempt for the same node starts from zero.
+	// Exceeding Config.RegMaxWaitTime removes the attempt.
 	totalWaitTime time.Duration
 
-	// reqCount tracks the number of registration requests sent.
-	reqCount int
+	// Attempts is the number of registration requests sent.
+	Attempts int
+
+	// LastError is the error of the last failed request, and LastErrorTime
+	// is the time when it occurred.
+	LastError     error
+	LastErrorTime mclock.AbsTime
+
+	// retries is the number of consecutive failed requests.
+	retries int
+
+	// regTime is when the attempt entered state Registered.
+	regTime mclock.AbsTime
 
 	index  int // index in regHeap
 	bucket *regBucket
 }
 
 func NewRegistration(topic TopicID, cfg Config) *Registration {
-	cfg = cfg.withDefaults()
+	cfg = cfg.WithDefaults()
+	if err := cfg.Validate(); err != nil {
+		panic("topicindex: " + err.Error())
+	}
 	r := &Registration{
 		topic:       topic,
 		cfg:         cfg,
 		log:         cfg.Log.New("topic", topic),
 		bucketCheck: make(map[int]struct{}, regTableDepth),
+		denied:      make(map[enode.ID]mclock.AbsTime),
+		rand:        cfg.JitterRand,
+	}
+	if r.rand == nil {
+		var seed [8]byte
+		for i := range seed {
+			seed[i] = cfg.Self[i] ^ topic[i]
+		}
+		r.rand = rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
 	}
 	dist := 256
 	for i := range r.buckets {
 		r.buckets[i] = regBucket{
-			att:  make(map[enode.ID]*RegAttempt),
-			dist: dist - (len(r.buckets) - 1) + i,
-			ips:  netutil.DistinctNetSet{Subnet: regBucketSubnet, Limit: regBucketIPLimit},
+			dist:   dist - (len(r.buckets) - 1) + i,
+			target: enode.ID(topic),
+			ips:    netutil.DistinctNetSet{Subnet: regBucketSubnet, Limit: regBucketIPLimit},
 		}
 	}
+	r.addNodes(nil, cfg.RegSeedNodes, true)
 	return r
 }
 
+// Clear removes all registration attempts, releasing the nodes referenced by them.
+// The registration must not be used after calling Clear.
+func (r *Registration) Clear() {
+	r.heap = nil
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		b.att = nil
+		b.count = [nRegStates]int{}
+		b.totalAttempted, b.totalSucceeded, b.totalFailed = 0, 0, 0
+		b.ips = netutil.DistinctNetSet{Subnet: regBucketSubnet, Limit: regBucketIPLimit}
+	}
+	r.recentErrors = nil
+	r.denied = nil
+}
+
 // Topic returns the topic being registered for.
 func (r *Registration) Topic() TopicID {
 	return r.topic
@@ -136,10 +209,219 @@ func (r *Registration) NodeCount() int {
 	return sum
 }
 
+// ActiveLen returns the number of attempts in state Waiting or Registered.
+func (r *Registration) ActiveLen() int {
+	sum := 0
+	for i := range r.buckets {
+		sum += r.buckets[i].count[Waiting] + r.buckets[i].count[Registered]
+	}
+	return sum
+}
+
+// IsSparse reports whether less than half of the table's active slots are used.
+func (r *Registration) IsSparse() bool {
+	return r.ActiveLen() < r.cfg.RegBucketSize*regTableDepth/2
+}
+
+// RegisteredLen returns the number of attempts in state Registered.
+func (r *Registration) RegisteredLen() int {
+	sum := 0
+	for i := range r.buckets {
+		sum += r.buckets[i].count[Registered]
+	}
+	return sum
+}
+
+// RegisteredNodes returns the registrars which currently hold an ad for the topic.
+func (r *Registration) RegisteredNodes() []*enode.Node {
+	var nodes []*enode.Node
+	for i := range r.buckets {
+		for _, att := range r.buckets[i].att {
+			if att.State == Registered {
+				nodes = append(nodes, att.Node)
+			}
+		}
+	}
+	return nodes
+}
+
+// NextRegistrationIn returns the time until the earliest ad placed by a registrar
+// expires and must be renewed. It returns zero when no ad is registered.
+func (r *Registration) NextRegistrationIn() time.Duration {
+	next := Never
+	for _, att := range r.heap {
+		if att.State == Registered && (IsNever(next) || att.NextTime < next) {
+			next = att.NextTime
+		}
+	}
+	if IsNever(next) {
+		return 0
+	}
+	if d := next.Sub(r.cfg.Clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// IsSaturated reports whether the table holds attempts and no bucket can take
+// more registrations. A bucket is full when it has RegBucketSize registrations
+// or when all of its attempts are registered.
+func (r *Registration) IsSaturated() bool {
+	empty := true
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if len(b.att) == 0 {
+			continue
+		}
+		empty = false
+		if b.count[Registered] < r.cfg.RegBucketSize && b.count[Registered] < len(b.att) {
+			return false
+		}
+	}
+	return !empty
+}
+
+// RegStats contains statistics about the registration table.
+type RegStats struct {
+	TotalAttempts int // number of attempts in all states
+	Standby       int
+	Waiting       int
+	Registered    int
+
+	// BucketUtilization is the number of attempts in each bucket.
+	// Buckets are ordered close -> far.
+	BucketUtilization [regTableDepth]int
+
+	// RecentErrors contains the most recent request errors, oldest first. Only the
+	// first NumRecentErrors entries are valid.
+	RecentErrors    [regRecentErrorsLimit]RegAttemptError
+	NumRecentErrors int
+
+	// NextAttempt describes the attempt that is due next. It is only valid when
+	// HasNextAttempt is true.
+	NextAttempt    RegAttemptInfo
+	HasNextAttempt bool
+}
+
+// RegBucketInfo describes the attempts in a registration bucket.
+type RegBucketInfo struct {
+	Dist     int              `json:"dist"`
+	Attempts []RegAttemptInfo `json:"attempts"`
+
+	TotalAttempted int `json:"totalAttempted"` // promotions to state Waiting
+	TotalSucceeded int `json:"totalSucceeded"` // accepted registrations
+	TotalFailed    int `json:"totalFailed"`    // failed requests
+}
+
+// RegAttemptInfo describes a registration attempt.
+type RegAttemptInfo struct {
+	NodeID        enode.ID        `json:"nodeID"`
+	State         RegAttemptState `json:"state"`
+	NextTime      time.Time       `json:"nextTime"` // zero for attempts in state Standby
+	TotalWaitTime time.Duration   `json:"totalWaitTime"`
+	TicketLen     int             `json:"ticketLen"`
+	Attempts      int             `json:"attempts"`
+}
+
+// BucketSnapshot returns the attempts and statistics of all buckets which have
+// attempts or have been used before, ordered close -> far.
+// Attempts in a bucket are sorted by node ID. This is meant for diagnostics only,
+// use Stats to monitor the registration.
+func (r *Registration) BucketSnapshot() []RegBucketInfo {
+	var (
+		now     = r.cfg.Clock.Now()
+		wallNow = timeNow()
+		buckets []RegBucketInfo
+	)
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if len(b.att) == 0 && b.totalAttempted == 0 {
+			continue
+		}
+		info := RegBucketInfo{
+			Dist:           b.dist,
+			Attempts:       make([]RegAttemptInfo, 0, len(b.att)),
+			TotalAttempted: b.totalAttempted,
+			TotalSucceeded: b.totalSucceeded,
+			TotalFailed:    b.totalFailed,
+		}
+		for _, att := range b.att {
+			info.Attempts = append(info.Attempts, attemptInfo(att, now, wallNow))
+		}
+		sort.Slice(info.Attempts, func(i, j int) bool {
+			return bytes.Compare(info.Attempts[i].NodeID[:], info.Attempts[j].NodeID[:]) < 0
+		})
+		buckets = append(buckets, info)
+	}
+	return buckets
+}
+
+func attemptInfo(att *RegAttempt, now mclock.AbsTime, wallNow time.Time) RegAttemptInfo {
+	ai := RegAttemptInfo{
+		NodeID:        att.Node.ID(),
+		State:         att.State,
+		TotalWaitTime: att.totalWaitTime,
+		TicketLen:     len(att.Ticket),
+		Attempts:      att.Attempts,
+	}
+	if att.State != Standby {
+		ai.NextTime = wallNow.Add(att.NextTime.Sub(now))
+	}
+	return ai
+}
+
+// RegEventType is the type of a RegEvent.
+type RegEventType int
+
+const (
+	RegEventSuccess RegEventType = iota // registrar accepted the registration
+	RegEventTicket                      // registrar issued a ticket
+	RegEventError                       // registration request failed
+)
+
+// RegEvent is emitted when a registration response has been processed.
+type RegEvent struct {
+	Type    RegEventType
+	Topic   TopicID
+	Attempt *RegAttempt // copy of the attempt after processing the response
+	Err     error       // set for RegEventError
+}
+
+// RegAttemptError describes a failed registration request.
+type RegAttemptError struct {
+	Node enode.ID
+	Err  error
+	Time mclock.AbsTime
+}
+
+// Stats returns statistics about the registration table.
+func (r *Registration) Stats() RegStats {
+	var st RegStats
+	for i, b := range &r.buckets {
+		st.Standby += b.count[Standby]
+		st.Waiting += b.count[Waiting]
+		st.Registered += b.count[Registered]
+		st.BucketUtilization[i] = len(b.att)
+	}
+	st.TotalAttempts = st.Standby + st.Waiting + st.Registered
+	st.NumRecentErrors = copy(st.RecentErrors[:], r.recentErrors)
+	if att, _ := r.NextAttemptInfo(); att != nil {
+		st.NextAttempt = attemptInfo(att, r.cfg.Clock.Now(), timeNow())
+		st.HasNextAttempt = true
+	}
+	return st
+}
+
 // AddNodes notifies the registration process about found nodes.
 //
 // 'src' is the source of the nodes.
 func (r *Registration) AddNodes(src *enode.Node, nodes []*enode.Node) {
+	r.addNodes(src, nodes, false)
+}
+
+// addNodes adds nodes to the table. Seed nodes are not subject to the bucket
+// capacity limits.
+func (r *Registration) addNodes(src *enode.Node, nodes []*enode.Node, seed bool) {
 	// Clear the one-per-bucket checker.
 	for i := range r.bucketCheck {
 		delete(r.bucketCheck, i)
@@ -148,14 +430,17 @@ func (r *Registration) AddNodes(src *enode.Node, nodes []*enode.Node) {
 	// Add the nodes.
 	for _, n := range nodes {
 		id := n.ID()
-		if id == r.cfg.Self {
+		if r.cfg.isExcluded(id) {
+			continue
+		}
+		if r.isDenied(id) {
+			r.log.Debug("Ignoring registration node", "nodeID", id, "reason", "blacklisted")
 			continue
 		}
 
 		bi := r.bucketIndex(id)
 		b := &r.buckets[bi]
-		attempt, ok := b.att[id]
-		if ok {
+		if attempt := b.get(id); attempt != nil {
 			// There is already an attempt scheduled with this node.
 			// Update the record if newer.
 			if attempt.Node.Seq() < n.Seq() {
@@ -170,57 +455,165 @@ func (r *Registration) AddNodes(src *enode.Node, nodes []*enode.Node) {
 			// every registration bucket. This avoids attacks where a single registrar can
 			// dominate a bucket.
 			if _, ok := r.bucketCheck[bi]; ok {
-				r.log.Debug("Ignoring registration node", "id", n.ID(), "reason", "one-per-bucket-rule")
+				r.log.Debug("Ignoring registration node", "nodeID", n.ID(), "reason", "one-per-bucket-rule")
 				continue
 			}
 			r.bucketCheck[bi] = struct{}{}
 		}
 
-		if b.count[Standby] >= r.cfg.RegBucketStandbyLimit {
+		if !seed && b.count[Standby] >= r.cfg.RegBucketStandbyLimit {
 			// There are enough replacements already.
 			continue
 		}
+		if !seed && len(b.att) >= r.cfg.RegBucketTotalCap {
+			// The bucket is full. Registered attempts are not limited by RegBucketSize,
+			// so they can fill the bucket even when there are few replacements.
+			continue
+		}
 
 		ip := n.IP()
 		if ip != nil && !netutil.IsLAN(ip) && !b.ips.Add(n.IP()) {
 			// IP doesn't fit in bucket limit.
-			r.log.Debug("Ignoring registration node", "id", n.ID(), "reason", "iplimit")
+			r.log.Debug("Ignoring registration node", "nodeID", n.ID(), "reason", "iplimit")
 			continue
 		}
 
 		// Create a new attempt.
 		att := &RegAttempt{Node: n, bucket: b, index: -1}
-		b.att[id] = att
+		if src != nil {
+			att.SourceID = src.ID()
+		}
+		b.insert(att)
 		b.count[att.State]++
 		r.refillAttempts(att.bucket)
 	}
 }
 
+// RemoveNode removes the attempt on the given node and prevents the node from
+// being added again for Config.RegBlacklistTTL. It returns true if the node was
+// in the registration table.
+func (r *Registration) RemoveNode(id enode.ID) bool {
+	now := r.cfg.Clock.Now()
+	for nid, expiry := range r.denied {
+		if now >= expiry {
+			delete(r.denied, nid)
+		}
+	}
+	r.denied[id] = now.Add(r.cfg.RegBlacklistTTL)
+
+	b := r.bucket(id)
+	att := b.get(id)
+	if att == nil {
+		return false
+	}
+	r.removeAttempt(att, "blacklisted")
+	r.refillAttempts(b)
+	return true
+}
+
+// isDenied reports whether the node was removed by RemoveNode recently.
+func (r *Registration) isDenied(id enode.ID) bool {
+	expiry, ok := r.denied[id]
+	if !ok {
+		return false
+	}
+	if r.cfg.Clock.Now() >= expiry {
+		delete(r.denied, id)
+		return false
+	}
+	return true
+}
+
 func (r *Registration) setAttemptState(att *RegAttempt, state RegAttemptState) {
+	r.validateTransition(att, att.State, state)
 	att.bucket.count[att.State]--
 	att.bucket.count[state]++
-	r.log.Trace("Registration attempt state changed", "id", att.Node.ID(), "state", state, "prev", att.State)
+	r.log.Trace("Registration attempt state changed", "nodeID", att.Node.ID(), "src", att.SourceID,
+		"state", state, "prevState", att.State, "totalWait", att.totalWaitTime, "regTable", att.bucket)
 	att.State = state
 }
 
-// refillAttempts promotes a registrar node from Standby to Waiting.
+// validateTransition panics if an attempt can't move from state 'from' to 'to'.
+// The valid transitions are:
+//
+//	Standby    -> Waiting     promotion by refillAttempts
+//	Waiting    -> Registered  HandleRegistered, while the request is in flight
+//	Registered -> Standby     demotion by limitSubnet
+//
+// Attempts in any state can also be removed from the table.
+func (r *Registration) validateTransition(att *RegAttempt, from, to RegAttemptState) {
+	var err error
+	switch {
+	case att.State != from:
+		err = fmt.Errorf("attempt is in state %v", att.State)
+	case r.isRemoved(att):
+		err = errors.New("attempt is not in the table")
+	case from == Standby && to == Waiting:
+		if att.index != -1 {
+			err = fmt.Errorf("standby attempt has index %d", att.index)
+		}
+	case from == Waiting && to == Registered:
+		if att.index != -2 {
+			err = fmt.Errorf("no request in flight (index %d)", att.index)
+		}
+	case from == Registered && to == Standby:
+	default:
+		err = errors.New("invalid transition")
+	}
+	if err != nil {
+		id := att.Node.ID().Bytes()
+		panic(fmt.Errorf("bad state transition %v -> %v of attempt (node %x): %v", from, to, id[:8], err))
+	}
+}
+
+// String summarizes the attempt counts of the bucket. It is used for logging.
+func (b *regBucket) String() string {
+	return fmt.Sprintf("dist=%d standby=%d waiting=%d registered=%d",
+		b.dist, b.count[Standby], b.count[Waiting], b.count[Registered])
+}
+
+// refillAttempts promotes a registrar node from Standby to Waiting. The node closest
+// to the topic is chosen unless Config.RegPromoteRandomly is set.
 // This must be called after every potential attempt state change in the bucket.
 func (r *Registration) refillAttempts(b *regBucket) {
-	if b.count[Waiting] >= r.cfg.RegBucketSize {
-		// Enough attempts in state 'Waiting'.
+	if b.count[Waiting] >= r.cfg.RegBucketSize || b.count[Standby] == 0 {
+		// Enough attempts in state 'Waiting', or nothing to promote.
 		return
 	}
 
+	// Attempts are sorted by distance, so the first standby attempt is the closest.
+	skip := 0
+	if r.cfg.RegPromoteRandomly {
+		skip = r.rand.Intn(b.count[Standby])
+	}
+	var promote *RegAttempt
 	for _, att := range b.att {
-		if att.State == Standby {
-			r.setAttemptState(att, Waiting)
-			att.NextTime = r.cfg.Clock.Now()
-			heap.Push(&r.heap, att)
+		if att.State != Standby {
+			continue
+		}
+		if skip == 0 {
+			promote = att
 			break
 		}
+		skip--
+	}
+	if promote != nil {
+		r.setAttemptState(promote, Waiting)
+		b.totalAttempted++
+		promote.NextTime = r.cfg.Clock.Now().Add(r.initialJitter())
+		heap.Push(&r.heap, promote)
 	}
 }
 
+// initialJitter returns a random delay for the first request of an attempt. This avoids
+// many nodes contacting registrars at the same time when they start simultaneously.
+func (r *Registration) initialJitter() time.Duration {
+	if r.cfg.RegInitialJitter <= 0 {
+		return 0
+	}
+	return time.Duration(r.rand.Int63n(int64(r.cfg.RegInitialJitter)))
+}
+
 // NextUpdateTime returns the next time Update should be called.
 func (r *Registration) NextUpdateTime() mclock.AbsTime {
 	if len(r.heap) > 0 {
@@ -235,6 +628,18 @@ func (r *Registration) NextUpdateTime() mclock.AbsTime {
 	return Never
 }
 
+// NextAttemptInfo returns the attempt that is due next and the time it is due.
+// This is the attempt processed by the next call to Update: an attempt in state
+// Waiting is returned by Update, an attempt in state Registered expires.
+// If there are no scheduled attempts, it returns nil and Never.
+func (r *Registration) NextAttemptInfo() (*RegAttempt, mclock.AbsTime) {
+	if len(r.heap) == 0 {
+		return nil, Never
+	}
+	att := r.heap[0]
+	return att, att.NextTime
+}
+
 // Update processes the attempt queue and returns the next attempt in state 'Waiting'.
 func (r *Registration) Update() *RegAttempt {
 	now := r.cfg.Clock.Now()
@@ -246,6 +651,9 @@ func (r *Registration) Update() *RegAttempt {
 		case Registered:
 			r.removeAttempt(att, "expired")
 			r.refillAttempts(att.bucket)
+			if r.cfg.OnExpired != nil {
+				r.cfg.OnExpired(r.topic, att.Node)
+			}
 		case Waiting:
 			return att
 		}
@@ -263,7 +671,12 @@ func (r *Registration) StartRequest(att *RegAttempt) {
 	}
 	heap.Remove(&r.heap, att.index)
 	att.index = -2
-	att.reqCount++
+	att.Attempts++
+}
+
+// isRemoved reports whether att is no longer part of the registration table.
+func (r *Registration) isRemoved(att *RegAttempt) bool {
+	return att.bucket.get(att.Node.ID()) != att
 }
 
 func (r *Registration) validate(att *RegAttempt) {
@@ -277,75 +690,245 @@ func (r *Registration) validate(att *RegAttempt) {
 // request with a ticket and waiting time.
 func (r *Registration) HandleTicketResponse(att *RegAttempt, ticket []byte, waitTime time.Duration) {
 	r.validate(att)
+	if r.isRemoved(att) {
+		return // node was removed while the request was in flight
+	}
 	att.totalWaitTime += waitTime
 
-	// Drop the attempt when the registrar makes us wait for longer than AdLifetime. This
-	// works because the entire ad cache will have been rotated after one lifetime, and so
-	// the registrar must be misbehaving if they didn't accept
-	if att.reqCount > 1 && att.totalWaitTime > r.cfg.RegAttemptTimeout {
+	// Drop the attempt when the registrar makes us wait for too long. The entire ad
+	// cache will have been rotated after one lifetime, so the registrar must be
+	// misbehaving if they didn't accept us by then.
+	if att.totalWaitTime > r.cfg.RegMaxWaitTime {
 		r.removeAttempt(att, "wtime-too-high")
+		r.refillAttempts(att.bucket)
 		return
 	}
 
-	// TODO: should a maximum number of retries be enforced here?
+	// Drop the attempt when the registrar keeps issuing tickets without ever
+	// accepting the registration.
+	if att.Attempts >= r.cfg.RegMaxAttempts {
+		r.removeAttempt(att, "too-many-attempts")
+		r.refillAttempts(att.bucket)
+		return
+	}
 
+	att.retries = 0
 	att.Ticket = ticket
 	att.NextTime = r.cfg.Clock.Now().Add(waitTime)
+	r.log.Trace("Got registration ticket", "nodeID", att.Node.ID(), "nextTime", att.NextTime, "totalWait", att.totalWaitTime)
 	heap.Push(&r.heap, att)
 }
 
 // HandleRegistered should be called when a node confirms topic registration.
+// The ttl is the ad lifetime announced by the registrar. When it is zero,
+// Config.RegDefaultTTL is assumed.
 func (r *Registration) HandleRegistered(att *RegAttempt, ttl time.Duration) {
 	r.validate(att)
+	if r.isRemoved(att) {
+		return // node was removed while the request was in flight
+	}
 
+	if ttl <= 0 {
+		ttl = r.cfg.RegDefaultTTL
+	}
 	// Prevent registrar from announcing an out-of-bounds ad lifetime.
 	if ttl > r.cfg.AdLifetime {
 		ttl = r.cfg.AdLifetime
 	}
 
-	r.log.Trace("Topic registration successful", "id", att.Node.ID(), "adlifetime", ttl)
+	att.retries = 0
+	att.bucket.totalSucceeded++
 	r.setAttemptState(att, Registered)
-	att.NextTime = r.cfg.Clock.Now().Add(ttl)
+	att.regTime = r.cfg.Clock.Now()
+	att.NextTime = att.regTime.Add(ttl)
+	r.log.Trace("Topic registration successful", "nodeID", att.Node.ID(), "adlifetime", ttl, "nextTime", att.NextTime)
 	heap.Push(&r.heap, att)
 
 	r.refillAttempts(att.bucket)
+	r.limitSubnet(att)
+	if r.cfg.OnRegistered != nil && att.State == Registered {
+		r.cfg.OnRegistered(r.topic, att.Node, att.NextTime)
+	}
+}
+
+// limitSubnet enforces Config.RegMaxSameSubnet for the /24 subnet of a registrar
+// which has just registered. If there are too many registered attempts in the
+// subnet, the oldest one is demoted to Standby.
+//
+// Note that the per-bucket IP limit already prevents this within a single bucket.
+// This check applies to the whole table.
+func (r *Registration) limitSubnet(att *RegAttempt) {
+	subnet, ok := regSubnet(att.Node)
+	if !ok {
+		return
+	}
+	var (
+		count  int
+		oldest *RegAttempt
+	)
+	for i := range r.buckets {
+		for _, a := range r.buckets[i].att {
+			if a.State != Registered {
+				continue
+			}
+			if s, ok := regSubnet(a.Node); !ok || s != subnet {
+				continue
+			}
+			count++
+			if oldest == nil || a.regTime < oldest.regTime {
+				oldest = a
+			}
+		}
+	}
+	if count <= r.cfg.RegMaxSameSubnet {
+		return
+	}
+
+	r.log.Debug("Too many registrars in subnet", "nodeID", oldest.Node.ID(), "ip", oldest.Node.IP(), "count", count)
+	if oldest.index >= 0 {
+		heap.Remove(&r.heap, oldest.index)
+	}
+	// The bucket is not refilled here. The number of waiting attempts doesn't change,
+	// and refilling would just promote the demoted node again if it is the only
+	// standby node in its bucket.
+	r.setAttemptState(oldest, Standby)
+	oldest.Ticket = nil
+	oldest.NextTime = 0
+}
+
+// regSubnet returns the /24 prefix of a node's IPv4 address. LAN addresses
+// are not considered.
+func regSubnet(n *enode.Node) (subnet [3]byte, ok bool) {
+	ip := n.IP()
+	if ip == nil || netutil.IsLAN(ip) {
+		return subnet, false
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return subnet, false
+	}
+	copy(subnet[:], ip4)
+	return subnet, true
 }
 
 // HandleErrorResponse should be called when a registration attempt fails.
+// The request is retried with exponential backoff until RegMaxRetries is reached,
+// at which point the attempt is removed.
 func (r *Registration) HandleErrorResponse(att *RegAttempt, err error) {
 	r.validate(att)
+	if r.isRemoved(att) {
+		return // node was removed while the request was in flight
+	}
 
-	r.log.Debug("Topic registration failed", "id", att.Node.ID(), "err", err)
-	r.removeAttempt(att, "error")
-	r.refillAttempts(att.bucket)
+	now := r.cfg.Clock.Now()
+	att.bucket.totalFailed++
+	att.LastError = err
+	att.LastErrorTime = now
+	if len(r.recentErrors) == regRecentErrorsLimit {
+		r.recentErrors = append(r.recentErrors[:0], r.recentErrors[1:]...)
+	}
+	r.recentErrors = append(r.recentErrors, RegAttemptError{att.Node.ID(), err, now})
+
+	if att.retries >= r.cfg.RegMaxRetries {
+		r.log.Debug("Topic registration failed", "nodeID", att.Node.ID(), "err", err, "retries", att.retries)
+		r.removeAttempt(att, "error")
+		r.refillAttempts(att.bucket)
+		return
+	}
+
+	att.retries++
+	backoff := r.retryBackoff(att.retries)
+	r.log.Debug("Topic registration failed, retrying", "nodeID", att.Node.ID(), "err", err, "backoff", backoff)
+	att.NextTime = now.Add(backoff)
+	heap.Push(&r.heap, att)
+}
+
+// retryBackoff computes the delay before retry number n. The base delay starts at
+// regMinBackoff and doubles for each retry. Up to 50% random jitter is added to
+// avoid synchronized retries. The result never exceeds RegMaxBackoff.
+func (r *Registration) retryBackoff(n int) time.Duration {
+	d := regMinBackoff
+	for i := 1; i < n && d < r.cfg.RegMaxBackoff; i++ {
+		d *= 2
+	}
+	d += time.Duration(r.rand.Int63n(int64(d/2) + 1))
+	if d > r.cfg.RegMaxBackoff {
+		d = r.cfg.RegMaxBackoff
+	}
+	return d
 }
 
 func (r *Registration) removeAttempt(att *RegAttempt, reason string) {
 	nid := att.Node.ID()
-	if att.bucket.att[nid] != att {
+	if att.bucket.get(nid) != att {
 		panic("trying to delete non-existent attempt")
 	}
-	r.log.Trace("Removing registration attempt", "id", att.Node.ID(), "state", att.State, "reason", reason)
+	r.log.Trace("Removing registration attempt", "nodeID", att.Node.ID(), "state", att.State, "reason", reason)
 	if att.index >= 0 {
 		heap.Remove(&r.heap, att.index)
 	}
-	delete(att.bucket.att, nid)
+	if ip := att.Node.IP(); ip != nil && !netutil.IsLAN(ip) {
+		att.bucket.ips.Remove(ip)
+	}
+	att.bucket.delete(nid)
 	att.bucket.count[att.State]--
 }
 
+// search returns the position of id in b.att. If the bucket doesn't contain an
+// attempt for id, it returns the position where the attempt would be inserted.
+func (b *regBucket) search(id enode.ID) int {
+	return sort.Search(len(b.att), func(i int) bool {
+		return enode.DistCmp(b.target, b.att[i].Node.ID(), id) >= 0
+	})
+}
+
+// get returns the attempt for the given node, or nil if there is none.
+func (b *regBucket) get(id enode.ID) *RegAttempt {
+	if i := b.search(id); i < len(b.att) && b.att[i].Node.ID() == id {
+		return b.att[i]
+	}
+	return nil
+}
+
+// insert adds an attempt. The bucket must not contain an attempt for the same node.
+func (b *regBucket) insert(att *RegAttempt) {
+	i := b.search(att.Node.ID())
+	b.att = append(b.att, nil)
+	copy(b.att[i+1:], b.att[i:])
+	b.att[i] = att
+}
+
+// delete removes the attempt for the given node.
+func (b *regBucket) delete(id enode.ID) {
+	if i := b.search(id); i < len(b.att) && b.att[i].Node.ID() == id {
+		copy(b.att[i:], b.att[i+1:])
+		b.att[len(b.att)-1] = nil
+		b.att = b.att[:len(b.att)-1]
+	}
+}
+
 func (r *Registration) bucket(id enode.ID) *regBucket {
 	return &r.buckets[r.bucketIndex(id)]
 }
 
 func (r *Registration) bucketIndex(id enode.ID) int {
 	dist := enode.LogDist(enode.ID(r.topic), id)
+	// Nodes closer than the table range go into the closest bucket.
+	if minDist := 256 - len(r.buckets) + 1; dist < minDist {
+		dist = minDist
+	}
 	index := dist - 256 + (len(r.buckets) - 1)
-	if index < 0 {
-		index = 0
+	if debugChecks && (index < 0 || index >= len(r.buckets)) {
+		panic(fmt.Errorf("bucket index %d out of range for distance %d", index, dist))
 	}
 	return index
 }
 
+// BucketFor returns the index of the bucket which holds the given node.
+func (r *Registration) BucketFor(id enode.ID) int {
+	return r.bucketIndex(id)
+}
+
 // regHeap is a priority queue of registration attempts. This should not be accessed
 // directly. Use heap.Push and heap.Pop to add and remove items.
 type regHeap []*RegAttempt
@@ -0,0 +1,161 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/p2p/netutil"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// regStateEnc is the persisted form of Registration.
+type regStateEnc struct {
+	Topic    TopicID
+	SavedAt  uint64 // wall-clock time of encoding, in unix milliseconds
+	Attempts []regAttemptEnc
+}
+
+type regAttemptEnc struct {
+	Record   enr.Record
+	State    uint
+	Ticket   []byte
+	Next     uint64 // time until NextTime at SavedAt, in milliseconds
+	WaitTime uint64 // totalWaitTime, in milliseconds
+	ReqCount uint64
+}
+
+// timeNow is the wall clock used for persisting registration state.
+// It is a variable so tests can move it.
+var timeNow = time.Now
+
+// MarshalBinary encodes the registration table, including tickets of attempts which
+// are waiting. Tickets of attempts with an in-flight request are not stored since
+// they will have been consumed by the request.
+func (r *Registration) MarshalBinary() ([]byte, error) {
+	now := r.cfg.Clock.Now()
+	enc := regStateEnc{
+		Topic:   r.topic,
+		SavedAt: uint64(timeNow().UnixMilli()),
+	}
+	for i := range r.buckets {
+		for _, att := range r.buckets[i].att {
+			a := regAttemptEnc{
+				Record:   *att.Node.Record(),
+				State:    uint(att.State),
+				WaitTime: uint64(att.totalWaitTime / time.Millisecond),
+				ReqCount: uint64(att.Attempts),
+			}
+			if att.index >= 0 {
+				if att.NextTime > now {
+					a.Next = uint64(att.NextTime.Sub(now) / time.Millisecond)
+				}
+				a.Ticket = att.Ticket
+			}
+			enc.Attempts = append(enc.Attempts, a)
+		}
+	}
+	return rlp.EncodeToBytes(&enc)
+}
+
+// UnmarshalBinary restores registration state created by MarshalBinary.
+//
+// Waiting attempts whose ticket has expired while the state was stored, and
+// registrations whose ad has expired, are reinserted in state Standby. The standby
+// limit is not enforced here because demoted attempts already had a place in the
+// bucket when the state was saved.
+func (r *Registration) UnmarshalBinary(data []byte) error {
+	var enc regStateEnc
+	if err := rlp.DecodeBytes(data, &enc); err != nil {
+		return err
+	}
+	if enc.Topic != r.topic {
+		return fmt.Errorf("topic mismatch: have %s, want %s", enc.Topic.Hex(), r.topic.Hex())
+	}
+
+	var (
+		now     = r.cfg.Clock.Now()
+		elapsed time.Duration
+	)
+	if savedAt := int64(enc.SavedAt); savedAt < timeNow().UnixMilli() {
+		elapsed = time.Duration(timeNow().UnixMilli()-savedAt) * time.Millisecond
+	}
+
+	for _, a := range enc.Attempts {
+		n, err := enode.New(enode.ValidSchemes, &a.Record)
+		if err != nil {
+			r.log.Debug("Ignoring invalid stored registration node", "err", err)
+			continue
+		}
+		id := n.ID()
+		if r.cfg.isExcluded(id) {
+			continue
+		}
+		b := r.bucket(id)
+		if b.get(id) != nil {
+			continue
+		}
+
+		// Check whether the stored state is still valid.
+		var (
+			state = Standby
+			next  = time.Duration(a.Next) * time.Millisecond
+		)
+		switch RegAttemptState(a.State) {
+		case Waiting:
+			if len(a.Ticket) > 0 && elapsed < next+ticketValidityWindow && b.count[Waiting] < r.cfg.RegBucketSize {
+				state = Waiting
+			}
+		case Registered:
+			if elapsed < next {
+				state = Registered
+			}
+		}
+		ip := n.IP()
+		if ip != nil && !netutil.IsLAN(ip) && !b.ips.Add(ip) {
+			continue
+		}
+
+		att := &RegAttempt{
+			Node:          n,
+			State:         state,
+			totalWaitTime: time.Duration(a.WaitTime) * time.Millisecond,
+			Attempts:      int(a.ReqCount),
+			bucket:        b,
+			index:         -1,
+		}
+		if state != Standby {
+			att.Ticket = a.Ticket
+			att.NextTime = now
+			if next > elapsed {
+				att.NextTime = now.Add(next - elapsed)
+			}
+			heap.Push(&r.heap, att)
+		}
+		b.insert(att)
+		b.count[state]++
+	}
+
+	for i := range r.buckets {
+		r.refillAttempts(&r.buckets[i])
+	}
+	return nil
+}
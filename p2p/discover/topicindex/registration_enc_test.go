@@ -0,0 +1,197 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"bytes"
+	"errors"
+	mrand "math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+// This test checks that registration state survives MarshalBinary/UnmarshalBinary.
+func TestRegistrationMarshalRoundTrip(t *testing.T) {
+	defer setTimeNow(time.Unix(1600000000, 0))()
+
+	check := func(seed int64) bool {
+		rand := mrand.New(mrand.NewSource(seed))
+		clock := new(mclock.Simulated)
+		cfg := testConfig(t)
+		cfg.Clock = clock
+		cfg.RegBucketSize = 3
+		r := NewRegistration(topic1, cfg)
+		r.AddNodes(nil, signedNodes(rand, 5+rand.Intn(30)))
+
+		// Drive the registration through random state transitions.
+		for i := 0; i < 50; i++ {
+			clock.Run(time.Duration(rand.Intn(10)) * time.Second)
+			att := r.Update()
+			if att == nil {
+				continue
+			}
+			r.StartRequest(att)
+			switch rand.Intn(4) {
+			case 0:
+				r.HandleTicketResponse(att, []byte{byte(i)}, time.Duration(1+rand.Intn(20))*time.Second)
+			case 1:
+				r.HandleRegistered(att, time.Duration(1+rand.Intn(60))*time.Second)
+			case 2:
+				r.HandleErrorResponse(att, errors.New("error"))
+			case 3:
+				// Leave the request in flight.
+			}
+		}
+
+		data, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+		r2 := NewRegistration(topic1, cfg)
+		if err := r2.UnmarshalBinary(data); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		if r2.NodeCount() != r.NodeCount() {
+			t.Errorf("node count mismatch: %d != %d", r2.NodeCount(), r.NodeCount())
+			return false
+		}
+		for i := range r.buckets {
+			for _, att := range r.buckets[i].att {
+				id := att.Node.ID()
+				att2 := r2.buckets[i].get(id)
+				if att2 == nil {
+					t.Errorf("attempt %v missing after unmarshal", id)
+					return false
+				}
+				if att2.totalWaitTime != att.totalWaitTime || att2.Attempts != att.Attempts {
+					t.Errorf("attempt %v: wait time/request count mismatch", id)
+					return false
+				}
+				now := clock.Now()
+				restored := att.index >= 0 && (att.State == Registered && att.NextTime > now || att.State == Waiting && att.Ticket != nil)
+				if !restored {
+					if att2.Ticket != nil || att2.State == Registered {
+						t.Errorf("attempt %v: unexpected state %v after unmarshal", id, att2.State)
+						return false
+					}
+					continue
+				}
+				// NextTime is stored with millisecond precision.
+				wantNext := att.NextTime
+				if wantNext < now {
+					wantNext = now
+				}
+				if att2.State != att.State || !bytes.Equal(att2.Ticket, att.Ticket) || wantNext.Sub(att2.NextTime) >= time.Millisecond {
+					t.Errorf("attempt %v mismatch: state %v, ticket %x, next %v; want state %v, ticket %x, next %v",
+						id, att2.State, att2.Ticket, att2.NextTime, att.State, att.Ticket, wantNext)
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 20}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// This test checks that UnmarshalBinary does not restore expired tickets and ads.
+func TestRegistrationUnmarshalExpired(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	defer setTimeNow(start)()
+
+	clock := new(mclock.Simulated)
+	cfg := testConfig(t)
+	cfg.Clock = clock
+	cfg.RegBucketSize = 2
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, signedNodes(mrand.New(mrand.NewSource(1)), 2))
+
+	ticketAtt := r.Update()
+	r.StartRequest(ticketAtt)
+	r.HandleTicketResponse(ticketAtt, []byte{1}, 10*time.Second)
+	regAtt := r.Update()
+	r.StartRequest(regAtt)
+	r.HandleRegistered(regAtt, 60*time.Second)
+
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(elapsed time.Duration) *Registration {
+		timeNow = func() time.Time { return start.Add(elapsed) }
+		r := NewRegistration(topic1, cfg)
+		if err := r.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Shortly after saving, both attempts are restored with adjusted NextTime.
+	r2 := load(2 * time.Second)
+	att := r2.bucket(ticketAtt.Node.ID()).get(ticketAtt.Node.ID())
+	if att.State != Waiting || att.Ticket == nil || att.NextTime != clock.Now().Add(8*time.Second) {
+		t.Fatalf("ticket attempt not restored: state %v, ticket %x, next %v", att.State, att.Ticket, att.NextTime)
+	}
+	att = r2.bucket(regAtt.Node.ID()).get(regAtt.Node.ID())
+	if att.State != Registered || att.NextTime != clock.Now().Add(58*time.Second) {
+		t.Fatalf("registered attempt not restored: state %v, next %v", att.State, att.NextTime)
+	}
+
+	// After the ticket validity window and ad lifetime, the state is reset.
+	r3 := load(90 * time.Second)
+	for _, orig := range []*RegAttempt{ticketAtt, regAtt} {
+		att := r3.bucket(orig.Node.ID()).get(orig.Node.ID())
+		if att.State == Registered || att.Ticket != nil {
+			t.Fatalf("expired attempt restored: state %v, ticket %x", att.State, att.Ticket)
+		}
+	}
+}
+
+func setTimeNow(t time.Time) (restore func()) {
+	timeNow = func() time.Time { return t }
+	return func() { timeNow = time.Now }
+}
+
+// signedNodes creates n nodes with valid 'v4' identity signatures.
+func signedNodes(rand *mrand.Rand, n int) []*enode.Node {
+	nodes := make([]*enode.Node, n)
+	for i := range nodes {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			panic(err)
+		}
+		var r enr.Record
+		r.Set(enr.IP(intIP(rand.Intn(255))))
+		if err := enode.SignV4(&r, key); err != nil {
+			panic(err)
+		}
+		node, err := enode.New(enode.ValidSchemes, &r)
+		if err != nil {
+			panic(err)
+		}
+		nodes[i] = node
+	}
+	return nodes
+}
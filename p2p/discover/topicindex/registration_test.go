@@ -17,12 +17,22 @@
 package topicindex
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
 	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 )
@@ -58,9 +68,32 @@ func TestRegistrationBuckets(t *testing.T) {
 	}
 }
 
+func TestRegistrationBucketFor(t *testing.T) {
+	r := NewRegistration(topic1, testConfig(t))
+	tests := []struct {
+		dist, index int
+	}{
+		{dist: 256, index: regTableDepth - 1},
+		{dist: 255, index: regTableDepth - 2},
+		{dist: 256 - regTableDepth + 1, index: 0},
+		{dist: 256 - regTableDepth, index: 0},
+		{dist: 100, index: 0},
+		{dist: 0, index: 0},
+	}
+	for _, test := range tests {
+		id := enode.RandomID(enode.ID(topic1), test.dist)
+		if index := r.BucketFor(id); index != test.index {
+			t.Errorf("distance %d: got bucket %d, want %d", test.dist, index, test.index)
+		}
+		if test.dist > 256-regTableDepth && r.buckets[test.index].dist != test.dist {
+			t.Errorf("distance %d: bucket %d has dist %d", test.dist, test.index, r.buckets[test.index].dist)
+		}
+	}
+}
+
 func rbContainsAll(b regBucket, nodes []*enode.Node) bool {
 	for _, n := range nodes {
-		if _, ok := b.att[n.ID()]; !ok {
+		if b.get(n.ID()) == nil {
 			return false
 		}
 	}
@@ -82,6 +115,256 @@ func TestRegistrationOnePerBucketCheck(t *testing.T) {
 	}
 }
 
+// This test checks that attempts record the registrar which supplied the node.
+func TestRegistrationSourceID(t *testing.T) {
+	cfg := testConfig(t)
+	r := NewRegistration(topic1, cfg)
+	src := nodeAtDistance(enode.ID(topic1), 255, intIP(1))
+	local := nodeAtDistance(enode.ID(topic1), 200, intIP(2))
+	remote := nodeAtDistance(enode.ID(topic1), 201, intIP(3))
+
+	r.AddNodes(nil, []*enode.Node{local})
+	r.AddNodes(src, []*enode.Node{remote, local})
+
+	if att := r.bucket(local.ID()).get(local.ID()); att.SourceID != (enode.ID{}) {
+		t.Errorf("wrong SourceID %v for node from local table", att.SourceID)
+	}
+	if att := r.bucket(remote.ID()).get(remote.ID()); att.SourceID != src.ID() {
+		t.Errorf("wrong SourceID %v for node from registrar, want %v", att.SourceID, src.ID())
+	}
+}
+
+// This test checks that Clear releases all nodes held by the registration.
+func TestRegistrationClear(t *testing.T) {
+	cfg := testConfig(t)
+	r := NewRegistration(topic1, cfg)
+
+	var released int32
+	nodes := nodesAtDistance(enode.ID(topic1), 200, 5)
+	for i := 240; i < 256; i++ {
+		nodes = append(nodes, nodeAtDistance(enode.ID(topic1), i, intIP(i)))
+	}
+	for _, n := range nodes {
+		runtime.SetFinalizer(n, func(*enode.Node) { atomic.AddInt32(&released, 1) })
+	}
+	r.AddNodes(nil, nodes)
+	for att := r.Update(); att != nil; att = r.Update() {
+		r.StartRequest(att)
+		r.HandleTicketResponse(att, []byte{1}, time.Minute)
+	}
+	if r.NodeCount() == 0 {
+		t.Fatal("no nodes added")
+	}
+	total := int32(len(nodes))
+	nodes = nil
+
+	r.Clear()
+	if n := r.NodeCount(); n != 0 {
+		t.Fatalf("NodeCount is %d after Clear", n)
+	}
+	for i := 0; i < 20 && atomic.LoadInt32(&released) < total; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&released); n < total {
+		t.Fatalf("%d of %d nodes still referenced after Clear", total-n, total)
+	}
+	runtime.KeepAlive(r)
+}
+
+// This test checks that registration state transitions are logged with the
+// expected fields.
+func TestRegistrationLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetHandler(log.StreamHandler(&buf, log.JSONFormat()))
+
+	cfg := testConfig(t)
+	cfg.Log = logger
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 30, 1))
+	att := r.Update()
+	r.StartRequest(att)
+	r.HandleRegistered(att, time.Minute)
+
+	required := []string{"topic", "nodeID", "state", "prevState", "totalWait", "regTable"}
+	var found int
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if rec["msg"] != "Registration attempt state changed" {
+			continue
+		}
+		found++
+		for _, key := range required {
+			if _, ok := rec[key]; !ok {
+				t.Errorf("field %q missing in %s", key, line)
+			}
+		}
+	}
+	if found == 0 {
+		t.Fatal("no state transitions logged")
+	}
+}
+
+// This test checks that nodes removed by RemoveNode cannot be re-added until
+// RegBlacklistTTL has passed.
+func TestRegistrationRemoveNode(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegBlacklistTTL = 10 * time.Minute
+	r := NewRegistration(topic1, cfg)
+	nodes := []*enode.Node{nodeAtDistance(enode.ID(topic1), 30, intIP(1))}
+	id := nodes[0].ID()
+	r.AddNodes(nil, nodes)
+
+	if r.RemoveNode(enode.ID{1}) {
+		t.Fatal("RemoveNode returned true for unknown node")
+	}
+	if !r.RemoveNode(id) {
+		t.Fatal("RemoveNode returned false for known node")
+	}
+	if r.NodeCount() != 0 {
+		t.Fatal("node not removed")
+	}
+
+	// The node is ignored while blacklisted.
+	simclock.Run(cfg.RegBlacklistTTL - 1)
+	r.AddNodes(nil, nodes)
+	if r.NodeCount() != 0 {
+		t.Fatal("blacklisted node was added")
+	}
+
+	// It can be added again after the TTL.
+	simclock.Run(1)
+	r.AddNodes(nil, nodes)
+	if r.NodeCount() != 1 {
+		t.Fatal("node not added after blacklist expiry")
+	}
+
+	// Removing a node while its request is in flight discards the response.
+	att := r.Update()
+	r.StartRequest(att)
+	r.RemoveNode(id)
+	r.HandleRegistered(att, time.Minute)
+	if r.NodeCount() != 0 || r.Update() != nil {
+		t.Fatal("response for removed node was applied")
+	}
+}
+
+func TestRegistrationBucketSnapshot(t *testing.T) {
+	simclock := new(mclock.Simulated)
+	wallNow := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer setTimeNow(wallNow)()
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	r := NewRegistration(topic1, cfg)
+	var (
+		n1 = nodeAtDistance(enode.ID(topic1), 250, intIP(1))
+		n2 = nodeAtDistance(enode.ID(topic1), 240, intIP(2))
+	)
+	r.AddNodes(nil, []*enode.Node{n1, n2})
+
+	// Give one of the nodes a ticket.
+	att := r.Update()
+	r.StartRequest(att)
+	r.HandleTicketResponse(att, []byte{1, 2, 3}, time.Minute)
+
+	snap := r.BucketSnapshot()
+	if len(snap) != 2 {
+		t.Fatalf("snapshot has %d buckets, want 2", len(snap))
+	}
+	found := make(map[enode.ID]RegAttemptInfo)
+	for _, b := range snap {
+		if len(b.Attempts) != 1 {
+			t.Fatalf("bucket %d has %d attempts, want 1", b.Dist, len(b.Attempts))
+		}
+		if b.Dist != enode.LogDist(enode.ID(topic1), b.Attempts[0].NodeID) {
+			t.Errorf("attempt in bucket %d has wrong distance", b.Dist)
+		}
+		found[b.Attempts[0].NodeID] = b.Attempts[0]
+	}
+	want := RegAttemptInfo{
+		NodeID:        att.Node.ID(),
+		State:         Waiting,
+		NextTime:      wallNow.Add(time.Minute),
+		TotalWaitTime: time.Minute,
+		TicketLen:     3,
+		Attempts:      1,
+	}
+	if got := found[att.Node.ID()]; got != want {
+		t.Errorf("wrong snapshot of attempt:\n got %+v\nwant %+v", got, want)
+	}
+	for _, n := range []*enode.Node{n1, n2} {
+		if _, ok := found[n.ID()]; !ok {
+			t.Errorf("node %v missing in snapshot", n.ID())
+		}
+	}
+}
+
+// This test checks the per-bucket request statistics reported by BucketSnapshot.
+func TestRegistrationBucketStats(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegBucketSize = 2
+	cfg.RegMaxRetries = 1
+	cfg.RegMaxBackoff = time.Minute
+	r := NewRegistration(topic1, cfg)
+	var (
+		a1 = nodeAtDistance(enode.ID(topic1), 250, intIP(1))
+		a2 = nodeAtDistance(enode.ID(topic1), 250, intIP(2))
+		b1 = nodeAtDistance(enode.ID(topic1), 240, intIP(3))
+	)
+	r.AddNodes(nil, []*enode.Node{a1, a2, b1})
+
+	// In the first round, a1 registers and the others fail. In the second round,
+	// a2 registers and b1 fails again, which removes it.
+	testErr := errors.New("test error")
+	for round := 0; round < 2; round++ {
+		for att := r.Update(); att != nil; att = r.Update() {
+			r.StartRequest(att)
+			switch id := att.Node.ID(); {
+			case id == a1.ID(), id == a2.ID() && round == 1:
+				r.HandleRegistered(att, time.Hour)
+			default:
+				r.HandleErrorResponse(att, testErr)
+			}
+		}
+		simclock.Run(cfg.RegMaxBackoff)
+	}
+
+	want := []RegBucketInfo{
+		{Dist: 240, TotalAttempted: 1, TotalFailed: 2},
+		{Dist: 250, TotalAttempted: 2, TotalSucceeded: 2, TotalFailed: 1},
+	}
+	snap := r.BucketSnapshot()
+	if len(snap) != len(want) {
+		t.Fatalf("snapshot has %d buckets, want %d", len(snap), len(want))
+	}
+	for i, w := range want {
+		b := snap[i]
+		if b.Dist != w.Dist || b.TotalAttempted != w.TotalAttempted || b.TotalSucceeded != w.TotalSucceeded || b.TotalFailed != w.TotalFailed {
+			t.Errorf("bucket %d: got %+v, want %+v", i, b, w)
+		}
+	}
+	if len(snap[0].Attempts) != 0 {
+		t.Error("removed attempt is still reported")
+	}
+
+	// Clear resets the statistics.
+	r.Clear()
+	if snap := r.BucketSnapshot(); len(snap) != 0 {
+		t.Fatalf("snapshot has %d buckets after Clear", len(snap))
+	}
+}
+
 // This checks that the per-bucket IP limit is applied in AddNodes.
 func TestRegistrationIPCheck(t *testing.T) {
 	cfg := testConfig(t)
@@ -192,6 +475,497 @@ func TestRegistrationExpiry(t *testing.T) {
 	}
 }
 
+// This test checks that the ad lifetime announced by the registrar is used, and
+// RegDefaultTTL is applied when the registrar doesn't announce one.
+func TestRegistrationDefaultTTL(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.AdLifetime = 20 * time.Minute
+	cfg.RegDefaultTTL = 5 * time.Minute
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 30, 2))
+
+	tests := []struct {
+		ttl, want time.Duration
+	}{
+		{ttl: 0, want: cfg.RegDefaultTTL},
+		{ttl: 7 * time.Minute, want: 7 * time.Minute},
+	}
+	for _, test := range tests {
+		att := r.Update()
+		if att == nil {
+			t.Fatal("no request scheduled")
+		}
+		r.StartRequest(att)
+		r.HandleRegistered(att, test.ttl)
+		if want := simclock.Now().Add(test.want); att.NextTime != want {
+			t.Fatalf("ttl %v: attempt expires at %v, want %v", test.ttl, att.NextTime, want)
+		}
+	}
+}
+
+// This test checks that failed registration requests are retried with
+// exponential backoff, and that the attempt is removed when retries are exhausted.
+func TestRegistrationErrorBackoff(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegMaxRetries = 4
+	cfg.RegMaxBackoff = 30 * time.Second
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 30, 1))
+
+	att := r.Update()
+	if att == nil {
+		t.Fatal("no request scheduled")
+	}
+	// Expected base delays are 5s, 10s, 20s, then capped at 30s.
+	minDelays := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second}
+	for i, min := range minDelays {
+		r.StartRequest(att)
+		r.HandleErrorResponse(att, errors.New("test error"))
+
+		now := simclock.Now()
+		next := r.NextUpdateTime()
+		max := min + min/2
+		if max > cfg.RegMaxBackoff {
+			max = cfg.RegMaxBackoff
+		}
+		if next < now.Add(min) || next > now.Add(max) {
+			t.Fatalf("retry %d: wrong backoff %v, want in [%v, %v]", i+1, next.Sub(now), min, max)
+		}
+		if r.Update() != nil {
+			t.Fatalf("retry %d: attempt returned before backoff elapsed", i+1)
+		}
+		simclock.Run(next.Sub(now))
+		if a := r.Update(); a != att {
+			t.Fatalf("retry %d: attempt not rescheduled", i+1)
+		}
+	}
+
+	// Retries are exhausted now, so the next error removes the attempt.
+	r.StartRequest(att)
+	r.HandleErrorResponse(att, errors.New("test error"))
+	if r.NodeCount() != 0 {
+		t.Fatal("attempt not removed after max retries")
+	}
+}
+
+// This test checks that the retry backoff jitter is drawn from Config.JitterRand,
+// so retry timing is reproducible.
+func TestRegistrationBackoffJitterRand(t *testing.T) {
+	backoffs := func() []time.Duration {
+		cfg := testConfig(t)
+		cfg.JitterRand = mrand.New(mrand.NewSource(1))
+		r := NewRegistration(topic1, cfg)
+		var ds []time.Duration
+		for i := 0; i < 20; i++ {
+			ds = append(ds, r.retryBackoff(3))
+		}
+		return ds
+	}
+	first, second := backoffs(), backoffs()
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("backoff not reproducible:\n%v\n%v", first, second)
+	}
+}
+
+// This test checks that attempts are dropped when the total ticket waiting time
+// exceeds RegMaxWaitTime, and that a standby node is promoted in their place.
+func TestRegistrationMaxWaitTime(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegBucketSize = 1
+	cfg.RegMaxWaitTime = 10 * time.Minute
+	r := NewRegistration(topic1, cfg)
+	nodes := []*enode.Node{
+		nodeAtDistance(enode.ID(r.Topic()), 250, intIP(1)),
+		nodeAtDistance(enode.ID(r.Topic()), 250, intIP(2)),
+	}
+	r.AddNodes(nil, nodes)
+
+	att := r.Update()
+	if att == nil {
+		t.Fatal("no request scheduled")
+	}
+	// Waiting for exactly RegMaxWaitTime is still fine.
+	for _, wt := range []time.Duration{4 * time.Minute, 6 * time.Minute} {
+		r.StartRequest(att)
+		r.HandleTicketResponse(att, []byte{1}, wt)
+		simclock.Run(wt)
+		if a := r.Update(); a != att {
+			t.Fatal("attempt not rescheduled after ticket response")
+		}
+	}
+	// Any further waiting exceeds the limit.
+	r.StartRequest(att)
+	r.HandleTicketResponse(att, []byte{1}, 1*time.Millisecond)
+	if att.bucket.get(att.Node.ID()) != nil {
+		t.Fatal("attempt not removed after exceeding RegMaxWaitTime")
+	}
+
+	// The standby node should have been promoted.
+	next := r.Update()
+	if next == nil || next == att {
+		t.Fatal("standby node not promoted")
+	}
+	if next.State != Waiting {
+		t.Fatal("promoted attempt has wrong state", next.State)
+	}
+}
+
+// This test checks that an attempt is dropped when the registrar keeps
+// issuing tickets without ever accepting the registration.
+func TestRegistrationMaxAttempts(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegBucketSize = 1
+	cfg.RegMaxAttempts = 5
+	r := NewRegistration(topic1, cfg)
+	nodes := []*enode.Node{
+		nodeAtDistance(enode.ID(r.Topic()), 250, intIP(1)),
+		nodeAtDistance(enode.ID(r.Topic()), 250, intIP(2)),
+	}
+	r.AddNodes(nil, nodes)
+
+	att := r.Update()
+	if att == nil {
+		t.Fatal("no request scheduled")
+	}
+	for i := 1; i < cfg.RegMaxAttempts; i++ {
+		r.StartRequest(att)
+		r.HandleTicketResponse(att, []byte{1}, time.Second)
+		simclock.Run(time.Second)
+		if a := r.Update(); a != att {
+			t.Fatalf("attempt not rescheduled after ticket response %d", i)
+		}
+	}
+	if att.Attempts != cfg.RegMaxAttempts-1 {
+		t.Fatalf("wrong attempt count %d", att.Attempts)
+	}
+
+	// The last ticket response exceeds the limit.
+	r.StartRequest(att)
+	r.HandleTicketResponse(att, []byte{1}, time.Second)
+	if att.bucket.get(att.Node.ID()) != nil {
+		t.Fatal("attempt not removed after RegMaxAttempts requests")
+	}
+	if next := r.Update(); next == nil || next == att {
+		t.Fatal("standby node not promoted")
+	}
+}
+
+// This test checks that the first requests to registrars in a bucket are
+// spread out by RegInitialJitter.
+func TestRegistrationInitialJitter(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegInitialJitter = 500 * time.Millisecond
+	cfg.JitterRand = mrand.New(mrand.NewSource(1))
+	r := NewRegistration(topic1, cfg)
+	nodes := nodesAtDistance(enode.ID(r.Topic()), 250, cfg.WithDefaults().RegBucketSize)
+	r.AddNodes(nil, nodes)
+
+	var (
+		b     = r.bucket(nodes[0].ID())
+		now   = simclock.Now()
+		times = make(map[mclock.AbsTime]bool)
+	)
+	if b.count[Waiting] != len(b.att) {
+		t.Fatalf("%d of %d attempts waiting", b.count[Waiting], len(b.att))
+	}
+	for _, att := range b.att {
+		if att.NextTime < now || att.NextTime >= now.Add(cfg.RegInitialJitter) {
+			t.Fatalf("attempt NextTime %v out of range", att.NextTime)
+		}
+		if times[att.NextTime] {
+			t.Fatalf("two attempts scheduled at %v", att.NextTime)
+		}
+		times[att.NextTime] = true
+	}
+}
+
+// This test checks that refillAttempts promotes the standby node closest to the topic.
+func TestRegistrationPromoteByDistance(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	r := NewRegistration(topic1, cfg)
+
+	// All nodes go into the closest bucket.
+	var (
+		target = enode.ID(r.Topic())
+		first  = nodeAtDistance(target, 100, intIP(1))
+		far    = nodeAtDistance(target, 210, intIP(2))
+		near   = nodeAtDistance(target, 150, intIP(3))
+		mid    = nodeAtDistance(target, 200, intIP(4))
+	)
+	r.AddNodes(nil, []*enode.Node{first})
+	r.AddNodes(nil, []*enode.Node{far, near, mid})
+
+	att := r.Update()
+	if att == nil || att.Node.ID() != first.ID() {
+		t.Fatal("first node not scheduled")
+	}
+	for _, want := range []*enode.Node{near, mid, far} {
+		r.StartRequest(att)
+		r.HandleRegistered(att, cfg.WithDefaults().AdLifetime)
+		att = r.Update()
+		if att == nil {
+			t.Fatal("no attempt promoted")
+		}
+		if att.Node.ID() != want.ID() {
+			t.Fatalf("promoted node at distance %d, want %d", enode.LogDist(target, att.Node.ID()), enode.LogDist(target, want.ID()))
+		}
+	}
+}
+
+// This test checks that request errors are recorded in the attempt and in RegStats.
+func TestRegistrationLastError(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegMaxRetries = 20
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 30, 1))
+
+	att := r.Update()
+	errTimeout := errors.New("timeout")
+	r.StartRequest(att)
+	r.HandleErrorResponse(att, errTimeout)
+	errTime := simclock.Now()
+
+	// The error is kept when the attempt is retried and gets a ticket.
+	simclock.Run(r.NextUpdateTime().Sub(simclock.Now()))
+	if r.Update() != att {
+		t.Fatal("attempt not retried")
+	}
+	r.StartRequest(att)
+	r.HandleTicketResponse(att, []byte{1}, time.Second)
+	if att.LastError != errTimeout || att.LastErrorTime != errTime {
+		t.Fatalf("wrong last error %v at %v", att.LastError, att.LastErrorTime)
+	}
+
+	// RecentErrors keeps the last few errors.
+	simclock.Run(time.Second)
+	for i := 0; i < regRecentErrorsLimit+5; i++ {
+		if r.Update() != att {
+			t.Fatal("attempt not scheduled")
+		}
+		r.StartRequest(att)
+		r.HandleErrorResponse(att, fmt.Errorf("error %d", i))
+		simclock.Run(r.NextUpdateTime().Sub(simclock.Now()))
+	}
+	st := r.Stats()
+	if st.NumRecentErrors != regRecentErrorsLimit {
+		t.Fatalf("wrong number of recent errors %d", st.NumRecentErrors)
+	}
+	if e := st.RecentErrors[st.NumRecentErrors-1]; e.Err != att.LastError || e.Node != att.Node.ID() {
+		t.Fatalf("wrong last entry in RecentErrors: %v", e)
+	}
+	// Stats doesn't allocate when errors have been recorded.
+	if allocs := testing.AllocsPerRun(10, func() { r.Stats() }); allocs != 0 {
+		t.Errorf("Stats allocates %v times per call", allocs)
+	}
+}
+
+// This test checks that NextAttemptInfo returns the attempt dispatched by the next Update.
+func TestRegistrationNextAttemptInfo(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegInitialJitter = 10 * time.Second
+	r := NewRegistration(topic1, cfg)
+	if att, next := r.NextAttemptInfo(); att != nil || next != Never {
+		t.Fatalf("empty registration returned next attempt %v at %v", att, next)
+	}
+	if st := r.Stats(); st.HasNextAttempt {
+		t.Fatal("empty registration has NextAttempt in stats")
+	}
+
+	for _, d := range []int{256, 255, 254, 253} {
+		r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), d, 2))
+	}
+	for i := 0; i < 8; i++ {
+		want, next := r.NextAttemptInfo()
+		if want == nil {
+			t.Fatalf("no next attempt in iteration %d", i)
+		}
+		if next != r.NextUpdateTime() {
+			t.Fatalf("NextAttemptInfo time %v != NextUpdateTime %v", next, r.NextUpdateTime())
+		}
+		if st := r.Stats(); !st.HasNextAttempt || st.NextAttempt.NodeID != want.Node.ID() {
+			t.Fatalf("wrong NextAttempt in stats: %v", st.NextAttempt)
+		}
+		simclock.Run(next.Sub(simclock.Now()))
+		att := r.Update()
+		if att != want {
+			t.Fatalf("Update returned %v, want %v", att.Node.ID(), want.Node.ID())
+		}
+		r.StartRequest(att)
+	}
+}
+
+// This test checks that NextRegistrationIn counts down to the earliest ad expiry,
+// and RegisteredNodes returns the registrars holding an ad.
+func TestRegistrationNextRegistrationIn(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.AdLifetime = 20 * time.Minute
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 30, 3))
+	if d := r.NextRegistrationIn(); d != 0 {
+		t.Fatalf("NextRegistrationIn is %v without registrations", d)
+	}
+	if nodes := r.RegisteredNodes(); len(nodes) != 0 {
+		t.Fatalf("RegisteredNodes returned %d nodes without registrations", len(nodes))
+	}
+
+	// Register two of the nodes. The third one remains in state Waiting.
+	var registered []*enode.Node
+	for _, ttl := range []time.Duration{10 * time.Minute, 5 * time.Minute} {
+		att := r.Update()
+		r.StartRequest(att)
+		r.HandleRegistered(att, ttl)
+		registered = append(registered, att.Node)
+	}
+	if d := r.NextRegistrationIn(); d != 5*time.Minute {
+		t.Fatalf("NextRegistrationIn is %v, want %v", d, 5*time.Minute)
+	}
+	simclock.Run(2 * time.Minute)
+	if d := r.NextRegistrationIn(); d != 3*time.Minute {
+		t.Fatalf("NextRegistrationIn is %v after 2m, want %v", d, 3*time.Minute)
+	}
+	nodes := r.RegisteredNodes()
+	if len(nodes) != 2 || !containsNode(nodes, registered[0]) || !containsNode(nodes, registered[1]) {
+		t.Fatalf("wrong registered nodes %v, want %v", nodes, registered)
+	}
+
+	// When the earliest ad expires, the countdown moves to the other one.
+	// The waiting attempt is started first, so Update processes the expiry.
+	r.StartRequest(r.Update())
+	simclock.Run(3 * time.Minute)
+	r.Update()
+	if d := r.NextRegistrationIn(); d != 5*time.Minute {
+		t.Fatalf("NextRegistrationIn is %v after first expiry, want %v", d, 5*time.Minute)
+	}
+	if nodes := r.RegisteredNodes(); len(nodes) != 1 || nodes[0] != registered[0] {
+		t.Fatalf("wrong registered nodes after first expiry: %v", nodes)
+	}
+}
+
+// This test checks the counters returned by Registration.Stats.
+func TestRegistrationStats(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 250, 3))
+	r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), 256, 1))
+
+	att := r.Update()
+	r.StartRequest(att)
+	r.HandleRegistered(att, cfg.AdLifetime)
+
+	st := r.Stats()
+	if st.TotalAttempts != 4 {
+		t.Errorf("wrong TotalAttempts %d, want 4", st.TotalAttempts)
+	}
+	if st.Registered != 1 || st.Waiting != 2 || st.Standby != 1 {
+		t.Errorf("wrong state counts: registered=%d waiting=%d standby=%d", st.Registered, st.Waiting, st.Standby)
+	}
+	last := len(st.BucketUtilization) - 1
+	if st.BucketUtilization[last] != 1 || st.BucketUtilization[last-6] != 3 {
+		t.Errorf("wrong bucket utilization %v", st.BucketUtilization)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { r.Stats() }); allocs != 0 {
+		t.Errorf("Stats allocates %v times per call", allocs)
+	}
+}
+
+func BenchmarkRegistrationStats(b *testing.B) {
+	r := NewRegistration(topic1, Config{})
+	for i := 200; i < 256; i++ {
+		r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), i, 5))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Stats()
+	}
+}
+
+func BenchmarkRegistrationBucket(b *testing.B) {
+	r := NewRegistration(topic1, Config{})
+	ids := make([]enode.ID, 1000)
+	for i := range ids {
+		dist := 256 - i%(regTableDepth+10)
+		ids[i] = enode.RandomID(enode.ID(r.Topic()), dist)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			r.bucket(id)
+		}
+	}
+}
+
+// This test adds many standby nodes in random order and checks that they are
+// promoted in order of distance to the topic.
+func TestRegistrationPromoteClosestFirst(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	cfg.RegBucketStandbyLimit = 20
+	r := NewRegistration(topic1, cfg)
+	target := enode.ID(r.Topic())
+
+	// The nodes all go into the closest bucket.
+	nodes := make([]*enode.Node, 20)
+	for i, p := range mrand.New(mrand.NewSource(1)).Perm(len(nodes)) {
+		nodes[i] = nodeAtDistance(target, 120+4*p, intIP(i+1))
+	}
+	for _, n := range nodes {
+		r.AddNodes(nil, []*enode.Node{n})
+	}
+
+	// The first node was promoted when it was added. The others
+	// must be promoted by distance.
+	att := r.Update()
+	if att == nil || att.Node.ID() != nodes[0].ID() {
+		t.Fatal("first node not scheduled")
+	}
+	rest := append([]*enode.Node{}, nodes[1:]...)
+	sort.Slice(rest, func(i, j int) bool {
+		return enode.DistCmp(target, rest[i].ID(), rest[j].ID()) < 0
+	})
+	ttl := cfg.WithDefaults().AdLifetime
+	for i, want := range rest {
+		r.StartRequest(att)
+		r.HandleRegistered(att, ttl)
+		att = r.Update()
+		if att == nil {
+			t.Fatalf("no attempt promoted in step %d", i)
+		}
+		if att.Node.ID() != want.ID() {
+			t.Fatalf("step %d: promoted node at distance %d, want %d", i, enode.LogDist(target, att.Node.ID()), enode.LogDist(target, want.ID()))
+		}
+	}
+}
+
 // nodesAtDistance creates n nodes for which enode.LogDist(base, node.ID()) == ld.
 func nodesAtDistance(base enode.ID, ld int, n int) []*enode.Node {
 	results := make([]*enode.Node, n)
@@ -211,3 +985,486 @@ func nodeAtDistance(base enode.ID, ld int, ip net.IP) *enode.Node {
 func intIP(i int) net.IP {
 	return net.IP{byte(i), 0, 2, byte(i)}
 }
+
+// This test checks that ActiveLen and IsSparse track the table through
+// additions, state changes and removals.
+func TestRegistrationActiveLen(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	r := NewRegistration(topic1, cfg)
+	if !r.IsSparse() {
+		t.Fatal("empty table not sparse")
+	}
+
+	check := func(context string) {
+		t.Helper()
+		st := r.Stats()
+		if n := r.ActiveLen(); n != st.Waiting+st.Registered {
+			t.Fatalf("%s: ActiveLen %d, want %d", context, n, st.Waiting+st.Registered)
+		}
+	}
+
+	nodes := nodesAtDistance(enode.ID(r.Topic()), 250, 3)
+	r.AddNodes(nil, nodes)
+	check("after add")
+	att := r.Update()
+	r.StartRequest(att)
+	check("after StartRequest")
+	r.HandleRegistered(att, cfg.AdLifetime)
+	check("after HandleRegistered")
+	if r.ActiveLen() == 0 {
+		t.Fatal("no active attempts")
+	}
+
+	for _, n := range nodes {
+		r.RemoveNode(n.ID())
+		check("after RemoveNode")
+	}
+	if r.ActiveLen() != 0 || !r.IsSparse() {
+		t.Fatalf("ActiveLen %d after removing all nodes", r.ActiveLen())
+	}
+
+	// Fill all buckets.
+	for i := 1; i <= 256; i++ {
+		r.AddNodes(nil, nodesAtDistance(enode.ID(r.Topic()), i, 2))
+	}
+	check("after filling")
+	if r.IsSparse() {
+		t.Fatalf("full table is sparse (ActiveLen %d)", r.ActiveLen())
+	}
+}
+
+// This test checks that registrars in the same /24 subnet are limited
+// across the whole table.
+func TestRegistrationSubnetLimit(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.RegMaxSameSubnet = 2
+	r := NewRegistration(topic1, cfg)
+
+	var (
+		target = enode.ID(r.Topic())
+		nodes  = []*enode.Node{
+			nodeAtDistance(target, 250, net.IP{1, 2, 3, 1}),
+			nodeAtDistance(target, 251, net.IP{1, 2, 3, 2}),
+			nodeAtDistance(target, 252, net.IP{1, 2, 4, 3}),
+			nodeAtDistance(target, 253, net.IP{1, 2, 3, 4}),
+		}
+		atts = make(map[enode.ID]*RegAttempt)
+	)
+	for _, n := range nodes {
+		r.AddNodes(nil, []*enode.Node{n})
+		att := r.Update()
+		if att == nil || att.Node.ID() != n.ID() {
+			t.Fatal("wrong attempt scheduled")
+		}
+		atts[n.ID()] = att
+		r.StartRequest(att)
+		r.HandleRegistered(att, cfg.AdLifetime)
+		simclock.Run(time.Second)
+	}
+
+	var states []RegAttemptState
+	for _, n := range nodes {
+		states = append(states, atts[n.ID()].State)
+	}
+	want := []RegAttemptState{Standby, Registered, Registered, Registered}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("wrong attempt states %v, want %v", states, want)
+	}
+}
+
+// This test checks that bucket attempts stay sorted by distance to the topic.
+func TestRegistrationBucketOrder(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketStandbyLimit = 50
+	r := NewRegistration(topic1, cfg)
+	target := enode.ID(r.Topic())
+
+	var nodes []*enode.Node
+	for i := 0; i < 50; i++ {
+		nodes = append(nodes, nodeAtDistance(target, 250, intIP(i)))
+	}
+	r.AddNodes(nil, nodes)
+	b := r.bucket(nodes[0].ID())
+
+	checkOrder := func() {
+		t.Helper()
+		for i := 1; i < len(b.att); i++ {
+			if enode.DistCmp(target, b.att[i-1].Node.ID(), b.att[i].Node.ID()) >= 0 {
+				t.Fatalf("attempts %d and %d out of order", i-1, i)
+			}
+		}
+	}
+	checkOrder()
+	if len(b.att) != len(nodes) {
+		t.Fatalf("bucket has %d attempts, want %d", len(b.att), len(nodes))
+	}
+	for i := 0; i < len(nodes); i += 2 {
+		r.RemoveNode(nodes[i].ID())
+	}
+	checkOrder()
+	for i, n := range nodes {
+		if att := b.get(n.ID()); (att != nil) != (i%2 == 1) {
+			t.Fatalf("wrong lookup result for node %d", i)
+		}
+	}
+}
+
+func BenchmarkRegBucketInsert(b *testing.B) {
+	cfg := Config{}.WithDefaults()
+	size := cfg.RegBucketSize + cfg.RegBucketStandbyLimit
+	atts := make([]*RegAttempt, size)
+	for i := range atts {
+		atts[i] = &RegAttempt{Node: nodeAtDistance(enode.ID(topic1), 250, intIP(i))}
+	}
+	bucket := regBucket{target: enode.ID(topic1)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, att := range atts {
+			bucket.insert(att)
+		}
+		for _, att := range atts {
+			bucket.delete(att.Node.ID())
+		}
+	}
+}
+
+// This test checks that registered attempts count towards RegBucketTotalCap.
+func TestRegistrationBucketTotalCap(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 2
+	cfg.RegBucketStandbyLimit = 2
+	r := NewRegistration(topic1, cfg)
+	if r.cfg.RegBucketTotalCap != 4 {
+		t.Fatalf("wrong default RegBucketTotalCap %d", r.cfg.RegBucketTotalCap)
+	}
+
+	var (
+		target = enode.ID(r.Topic())
+		nodes  []*enode.Node
+	)
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, nodeAtDistance(target, 250, intIP(i+1)))
+	}
+	b := r.bucket(nodes[0].ID())
+
+	// Register four nodes, two at a time. The bucket never has standby nodes.
+	for i := 0; i < 4; i += 2 {
+		r.AddNodes(nil, nodes[i:i+2])
+		for j := 0; j < 2; j++ {
+			att := r.Update()
+			r.StartRequest(att)
+			r.HandleRegistered(att, cfg.AdLifetime)
+		}
+	}
+	if b.count[Registered] != 4 || b.count[Standby] != 0 {
+		t.Fatalf("wrong bucket state: %v", b)
+	}
+
+	// The fifth node doesn't fit.
+	r.AddNodes(nil, nodes[4:])
+	if b.get(nodes[4].ID()) != nil {
+		t.Fatal("node added to full bucket")
+	}
+}
+
+// This test performs random operations on a Registration and checks that the
+// attempt heap stays consistent after each of them.
+func TestRegistrationHeapInvariant(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.AdLifetime = 10 * time.Minute
+	cfg.RegBucketSize = 3
+	cfg.RegBlacklistTTL = time.Minute
+	r := NewRegistration(topic1, cfg)
+
+	var (
+		rng      = mrand.New(mrand.NewSource(1))
+		target   = enode.ID(r.Topic())
+		nodes    []*enode.Node
+		inflight []*RegAttempt
+	)
+	for i := 0; i < 200; i++ {
+		nodes = append(nodes, nodeAtDistance(target, 240+rng.Intn(16), intIP(i+1)))
+	}
+
+	for i := 0; i < 5000; i++ {
+		var op string
+		switch rng.Intn(6) {
+		case 0:
+			op = "AddNodes"
+			k := rng.Intn(len(nodes) - 5)
+			r.AddNodes(nil, nodes[k:k+5])
+		case 1:
+			op = "StartRequest"
+			if att := r.Update(); att != nil {
+				r.StartRequest(att)
+				inflight = append(inflight, att)
+			}
+		case 2:
+			if len(inflight) == 0 {
+				continue
+			}
+			k := rng.Intn(len(inflight))
+			att := inflight[k]
+			inflight = append(inflight[:k], inflight[k+1:]...)
+			switch rng.Intn(3) {
+			case 0:
+				op = "HandleTicketResponse"
+				r.HandleTicketResponse(att, []byte{1}, time.Duration(rng.Intn(60))*time.Second)
+			case 1:
+				op = "HandleRegistered"
+				r.HandleRegistered(att, time.Duration(rng.Intn(600))*time.Second)
+			case 2:
+				op = "HandleErrorResponse"
+				r.HandleErrorResponse(att, errors.New("test error"))
+			}
+		case 3:
+			op = "RemoveNode"
+			r.RemoveNode(nodes[rng.Intn(len(nodes))].ID())
+		case 4:
+			op = "Update"
+			r.Update()
+		case 5:
+			op = "Run"
+			simclock.Run(time.Duration(rng.Intn(30)) * time.Second)
+		}
+		if err := checkRegHeap(r); err != nil {
+			t.Fatalf("op %d (%s): %v", i, op, err)
+		}
+	}
+}
+
+// checkRegHeap verifies the heap invariant and attempt indexes of r.
+func checkRegHeap(r *Registration) error {
+	for i, att := range r.heap {
+		if att.index != i {
+			return fmt.Errorf("attempt at position %d has index %d", i, att.index)
+		}
+		if att.State == Standby {
+			return fmt.Errorf("standby attempt at position %d", i)
+		}
+		if i > 0 {
+			parent := r.heap[(i-1)/2]
+			if parent.NextTime > att.NextTime {
+				return fmt.Errorf("attempt at position %d scheduled before its parent (%v < %v)", i, att.NextTime, parent.NextTime)
+			}
+		}
+	}
+	for _, b := range r.buckets {
+		for _, att := range b.att {
+			if att.index >= 0 && (att.index >= len(r.heap) || r.heap[att.index] != att) {
+				return fmt.Errorf("attempt with index %d not at its heap position", att.index)
+			}
+		}
+	}
+	return nil
+}
+
+func containsNode(nodes []*enode.Node, n *enode.Node) bool {
+	for _, m := range nodes {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// This test checks that Config.RegSeedNodes are added to a new Registration
+// even when they exceed the bucket capacity.
+func TestRegistrationSeedNodes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	cfg.RegBucketStandbyLimit = 1
+	cfg.RegBucketTotalCap = 2
+	cfg.RegSeedNodes = nodesAtDistance(enode.ID(topic1), 256, 4)
+	r := NewRegistration(topic1, cfg)
+
+	if r.NodeCount() != len(cfg.RegSeedNodes) {
+		t.Fatalf("wrong node count %d, want %d", r.NodeCount(), len(cfg.RegSeedNodes))
+	}
+	if !rbContainsAll(r.buckets[len(r.buckets)-1], cfg.RegSeedNodes) {
+		t.Fatal("seed nodes missing in last bucket")
+	}
+
+	// Regular additions are still subject to the limit.
+	r.AddNodes(nil, nodesAtDistance(enode.ID(topic1), 256, 1))
+	if r.NodeCount() != len(cfg.RegSeedNodes) {
+		t.Fatalf("node added to full bucket, count %d", r.NodeCount())
+	}
+}
+
+// This test checks that the waiting times of ticket responses are accumulated
+// in the attempt, and that a new attempt for the same node starts from zero.
+func TestRegistrationTotalWaitTime(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	r := NewRegistration(topic1, cfg)
+	node := nodeAtDistance(enode.ID(r.Topic()), 250, intIP(1))
+	r.AddNodes(nil, []*enode.Node{node})
+
+	att := r.Update()
+	if att == nil {
+		t.Fatal("no request scheduled")
+	}
+	var total time.Duration
+	for _, wt := range []time.Duration{3 * time.Second, 0, 10 * time.Second, 1 * time.Millisecond} {
+		r.StartRequest(att)
+		r.HandleTicketResponse(att, []byte{1}, wt)
+		total += wt
+		if att.totalWaitTime != total {
+			t.Fatalf("wrong totalWaitTime %v, want %v", att.totalWaitTime, total)
+		}
+		simclock.Run(wt)
+		if a := r.Update(); a != att {
+			t.Fatal("attempt not rescheduled after ticket response")
+		}
+	}
+
+	// Re-adding the node after removal creates a fresh attempt.
+	r.removeAttempt(att, "test")
+	r.AddNodes(nil, []*enode.Node{node})
+	att2 := att.bucket.get(node.ID())
+	if att2 == nil || att2 == att {
+		t.Fatal("node not re-added")
+	}
+	if att2.totalWaitTime != 0 {
+		t.Fatalf("new attempt has totalWaitTime %v, want zero", att2.totalWaitTime)
+	}
+}
+
+// This test checks that Config.OnRegistered and Config.OnExpired are called
+// once for every registration and expiry.
+func TestRegistrationCallbacks(t *testing.T) {
+	type regCall struct {
+		topic  TopicID
+		id     enode.ID
+		expiry mclock.AbsTime
+	}
+	var (
+		simclock   = new(mclock.Simulated)
+		registered []regCall
+		expired    []regCall
+	)
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	cfg.OnRegistered = func(topic TopicID, n *enode.Node, expiry mclock.AbsTime) {
+		registered = append(registered, regCall{topic, n.ID(), expiry})
+	}
+	cfg.OnExpired = func(topic TopicID, n *enode.Node) {
+		expired = append(expired, regCall{topic: topic, id: n.ID()})
+	}
+	r := NewRegistration(topic1, cfg)
+	node := nodeAtDistance(enode.ID(topic1), 250, intIP(1))
+	r.AddNodes(nil, []*enode.Node{node})
+
+	att := r.Update()
+	r.StartRequest(att)
+	r.HandleRegistered(att, time.Minute)
+	want := []regCall{{topic1, node.ID(), simclock.Now().Add(time.Minute)}}
+	if !reflect.DeepEqual(registered, want) {
+		t.Fatalf("wrong OnRegistered calls %v, want %v", registered, want)
+	}
+	if len(expired) != 0 {
+		t.Fatal("OnExpired called before expiry")
+	}
+
+	simclock.Run(time.Minute)
+	r.Update()
+	r.Update()
+	want = []regCall{{topic: topic1, id: node.ID()}}
+	if !reflect.DeepEqual(expired, want) {
+		t.Fatalf("wrong OnExpired calls %v, want %v", expired, want)
+	}
+	if len(registered) != 1 {
+		t.Fatalf("OnRegistered called %d times", len(registered))
+	}
+}
+
+// This test checks that invalid attempt state transitions are detected.
+func TestRegistrationInvalidTransition(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RegBucketSize = 1
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(topic1), 250, 2))
+	waiting := r.Update()
+
+	var standby *RegAttempt
+	for _, att := range waiting.bucket.att {
+		if att.State == Standby {
+			standby = att
+		}
+	}
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"standby to registered", func() { r.setAttemptState(standby, Registered) }},
+		{"waiting without request", func() { r.setAttemptState(waiting, Registered) }},
+		{"waiting to standby", func() { r.setAttemptState(waiting, Standby) }},
+		{"wrong from state", func() { r.validateTransition(waiting, Standby, Waiting) }},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", test.name)
+				}
+			}()
+			test.fn()
+		}()
+	}
+}
+
+// This test checks an attempt through several ticket rounds followed by
+// registration.
+func TestRegistrationTicketRounds(t *testing.T) {
+	simclock := new(mclock.Simulated)
+
+	cfg := testConfig(t)
+	cfg.Clock = simclock
+	r := NewRegistration(topic1, cfg)
+	r.AddNodes(nil, nodesAtDistance(enode.ID(topic1), 250, 1))
+
+	att := r.Update()
+	if att == nil {
+		t.Fatal("no request scheduled")
+	}
+	var total time.Duration
+	for round := 1; round <= 5; round++ {
+		r.StartRequest(att)
+		wt := time.Duration(round) * time.Second
+		r.HandleTicketResponse(att, []byte{byte(round)}, wt)
+		total += wt
+		if att.State != Waiting || att.Attempts != round || att.totalWaitTime != total {
+			t.Fatalf("round %d: wrong attempt state=%v attempts=%d totalWait=%v", round, att.State, att.Attempts, att.totalWaitTime)
+		}
+		if !bytes.Equal(att.Ticket, []byte{byte(round)}) {
+			t.Fatalf("round %d: ticket not updated", round)
+		}
+		if r.Update() != nil {
+			t.Fatalf("round %d: attempt due before waiting time", round)
+		}
+		simclock.Run(wt)
+		if r.Update() != att {
+			t.Fatalf("round %d: attempt not due after waiting time", round)
+		}
+	}
+
+	r.StartRequest(att)
+	r.HandleRegistered(att, time.Minute)
+	if att.State != Registered || att.Attempts != 6 || att.totalWaitTime != total {
+		t.Fatalf("wrong attempt after registration state=%v attempts=%d totalWait=%v", att.State, att.Attempts, att.totalWaitTime)
+	}
+	if r.RegisteredLen() != 1 {
+		t.Fatal("attempt not counted as registered")
+	}
+}
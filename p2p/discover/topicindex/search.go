@@ -17,8 +17,12 @@
 package topicindex
 
 import (
-	"time"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
 
+	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 )
 
@@ -30,8 +34,8 @@ const (
 	// (closest) bucket.
 	searchTableDepth = 40
 
-	// This defines the minimum delay between two lookups started by Search.
-	searchLookupMinDelay = 3 * time.Second
+	// searchBucketSourceLimit is the maximum source diversity tracked per bucket.
+	searchBucketSourceLimit = 16
 )
 
 // Search is the state associated with searching for a single topic.
@@ -42,66 +46,276 @@ type Search struct {
 	// Note: search buckets are ordered far -> close.
 	buckets [searchTableDepth]searchBucket
 
-	resultBuffer []*enode.Node
-	numResults   int
+	// resultBuffer is a ring buffer of SearchMaxResults results. resultHead is the
+	// index of the oldest result, resultLen the number of buffered results.
+	resultBuffer   []*enode.Node
+	resultHead     int
+	resultLen      int
+	numResults     int
+	droppedResults int
+
+	// seen tracks IDs of recently returned results.
+	// seenOrder holds the same IDs in insertion order.
+	seen      map[enode.ID]struct{}
+	seenOrder []enode.ID
+
+	// askedOrder holds the IDs of asked nodes in the order they were asked,
+	// including IDs restored by UnmarshalAskedSet.
+	askedOrder []enode.ID
 
 	queriesWithoutNewNodes int
+	lookupRounds           int            // number of AddNodes calls
+	lastQuery              mclock.AbsTime // start of the current query batch
+	batchQueries           int            // number of queries in the current batch
+	queryStarted           bool
+
+	// For weighted query target sampling: rand is seeded from the topic, and
+	// weightedTarget is the current sampled query target.
+	rand           *rand.Rand
+	weightedTarget *enode.Node
 }
 
 type searchBucket struct {
 	dist       int
 	new        map[enode.ID]*enode.Node
-	asked      map[enode.ID]struct{}
+	pending    map[enode.ID]*enode.Node // queries started, but no results yet
+	asked      map[enode.ID]*enode.Node
 	numResults int
+
+	// nearest caches the node in 'new' which is closest to the topic.
+	// It is reset when 'new' changes.
+	nearest *enode.Node
+
+	// restored holds IDs loaded by UnmarshalAskedSet which aren't in the bucket yet.
+	// When a node with one of these IDs is added, it goes directly into 'asked'.
+	restored map[enode.ID]struct{}
+
+	// sources holds the IDs of nodes which contributed nodes to the bucket.
+	// sourceDiversity is the number of these sources, up to searchBucketSourceLimit.
+	sources         map[enode.ID]struct{}
+	sourceDiversity int
 }
 
 // NewSearch creates a new topic search state.
 func NewSearch(topic TopicID, config Config) *Search {
-	config = config.withDefaults()
-	s := &Search{cfg: config, topic: topic}
+	config = config.WithDefaults()
+	if err := config.Validate(); err != nil {
+		panic("topicindex: " + err.Error())
+	}
+	s := &Search{
+		cfg:          config,
+		topic:        topic,
+		seen:         make(map[enode.ID]struct{}),
+		resultBuffer: make([]*enode.Node, config.SearchMaxResults),
+		rand:         rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(topic[:8])))),
+	}
 	dist := 256
 	for i := range s.buckets {
 		s.buckets[i].new = make(map[enode.ID]*enode.Node)
-		s.buckets[i].asked = make(map[enode.ID]struct{})
+		s.buckets[i].pending = make(map[enode.ID]*enode.Node)
+		s.buckets[i].asked = make(map[enode.ID]*enode.Node)
 		s.buckets[i].dist = dist
 		dist--
 	}
+	for _, n := range config.SearchSeedNodes {
+		if !config.isExcluded(n.ID()) {
+			s.bucket(n.ID()).add(n)
+		}
+	}
+	return s
+}
+
+// SearchStats contains statistics about a topic search.
+type SearchStats struct {
+	Progress float64 // fraction of table capacity that was asked, in [0, 1]
+	Results  int     // number of results found
+	Asked    int     // number of nodes asked
+	Unasked  int     // number of nodes not asked yet
+
+	// DroppedResults is the number of results which were discarded because the
+	// result buffer was full.
+	DroppedResults int
+
+	// BucketSourceDiversity is the number of distinct source nodes which
+	// contributed to each bucket. Buckets are ordered far -> close.
+	BucketSourceDiversity []int
+}
+
+// Stats returns statistics about the search.
+func (s *Search) Stats() SearchStats {
+	st := SearchStats{
+		Results:               s.numResults,
+		DroppedResults:        s.droppedResults,
+		BucketSourceDiversity: make([]int, len(s.buckets)),
+	}
+	for i, b := range &s.buckets {
+		st.Asked += len(b.asked)
+		st.Unasked += len(b.new) + len(b.pending)
+		st.BucketSourceDiversity[i] = b.sourceDiversity
+	}
+	st.Progress = s.progress(st.Asked)
+	return st
+}
+
+// Progress returns the fraction of the search table capacity that has been asked.
+func (s *Search) Progress() float64 {
+	var asked int
+	for _, b := range &s.buckets {
+		asked += len(b.asked)
+	}
+	return s.progress(asked)
+}
+
+func (s *Search) progress(asked int) float64 {
+	p := float64(asked) / float64(searchTableDepth*s.cfg.SearchBucketSize)
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// ResultCount returns the number of results found so far.
+func (s *Search) ResultCount() int {
+	return s.numResults
+}
+
+// Topic returns the topic being searched for.
+func (s *Search) Topic() TopicID {
+	return s.topic
+}
+
+// NewSearchFromNodes creates a search state which is seeded with known nodes, for
+// example the nodes of the local node table. The nodes are added as if returned by
+// a lookup.
+func NewSearchFromNodes(topic TopicID, config Config, nodes []*enode.Node) *Search {
+	s := NewSearch(topic, config)
+	s.AddNodes(nil, nodes)
+	return s
+}
+
+// NewSearchFromPrior creates a search state which continues where prior left off.
+// Nodes that were not asked by the prior search are carried over, including those
+// with a query in progress. Unless Config.SearchColdStart is set, the nodes asked
+// by the prior search are added as well, so they are queried again for new results.
+func NewSearchFromPrior(prior *Search, config Config) *Search {
+	s := NewSearch(prior.topic, config)
+	for i := range prior.buckets {
+		for _, n := range prior.buckets[i].new {
+			s.buckets[i].add(n)
+		}
+		for _, n := range prior.buckets[i].pending {
+			s.buckets[i].add(n)
+		}
+	}
+	if !s.cfg.SearchColdStart {
+		s.AddNodes(nil, prior.AskedNodes())
+	}
 	return s
 }
 
+// AskedNodes returns all nodes which have been queried.
+func (s *Search) AskedNodes() []*enode.Node {
+	var nodes []*enode.Node
+	for i := range s.buckets {
+		for _, n := range s.buckets[i].asked {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
 // IsDone reports whether the search table is saturated. When it returns true,
 // this search state should be abandoned and a new search started using a
 // fresh Search instance.
+//
+// The search is done when any of these conditions holds:
+//
+//   - SearchMaxResults results have been found.
+//   - All nodes in the closest SearchBucketSize non-empty buckets were asked.
+//   - No unasked nodes remain, at least SearchMinLookupRounds lookups were done,
+//     and the last SearchMaxEmptyRounds lookups didn't yield any new nodes.
+//
+// The search is never done before SearchMinResults results have been found.
 func (s *Search) IsDone() bool {
-	// TODO: what's the condition here?
-	//
-	// Ideas:
-	//
-	//   - n total results reached
-	//   - results from n sources received
-	//   - closest nodes reached (requires improved lookup tracking)
-	//   - buckets fuller than X
-
-	// The search cannot be done while there are unused results in the buffer,
-	// or while there are still nodes that could be asked.
-	if len(s.resultBuffer) > 0 {
+	// The search cannot be done while there are unused results in the buffer.
+	if s.resultLen > 0 {
 		return false
 	}
-	for _, b := range s.buckets {
-		if len(b.new) > 0 {
+	if s.numResults < s.cfg.SearchMinResults {
+		return false
+	}
+	if s.numResults >= s.cfg.SearchMaxResults {
+		return true
+	}
+	if s.closestBucketsAsked() {
+		return true
+	}
+	for i := s.queryDepthLimit(); i < len(s.buckets); i++ {
+		if s.buckets[i].hasUnasked() {
 			return false
 		}
 	}
-	// No unasked nodes remain. Consider it done when the last
-	// two lookups didn't yield any new nodes.
-	return s.queriesWithoutNewNodes >= 2
+	if s.lookupRounds < s.cfg.SearchMinLookupRounds {
+		// Give sparse networks a chance before declaring the search done.
+		return false
+	}
+	return s.queriesWithoutNewNodes >= s.cfg.SearchMaxEmptyRounds
+}
+
+// queryDepthLimit returns the index of the farthest bucket which is used for queries.
+// Only nodes in the closest Config.SearchMaxBucketDepth non-empty buckets are queried.
+// Nodes in farther buckets are kept, but not queried.
+func (s *Search) queryDepthLimit() int {
+	n := 0
+	for i := len(s.buckets) - 1; i >= 0; i-- {
+		if s.buckets[i].count() == 0 {
+			continue
+		}
+		if n++; n == s.cfg.SearchMaxBucketDepth {
+			return i
+		}
+	}
+	return 0
+}
+
+// closestBucketsAsked reports whether all nodes in the closest SearchBucketSize
+// non-empty buckets have been asked.
+func (s *Search) closestBucketsAsked() bool {
+	var n int
+	for i := len(s.buckets) - 1; i >= 0 && n < s.cfg.SearchBucketSize; i-- {
+		b := &s.buckets[i]
+		if b.count() == 0 {
+			continue
+		}
+		if b.hasUnasked() {
+			return false
+		}
+		n++
+	}
+	return n == s.cfg.SearchBucketSize
 }
 
 // AddNodes adds the results of a lookup to the table.
 func (s *Search) AddNodes(src *enode.Node, nodes []*enode.Node) {
+	s.lookupRounds++
+	if !s.addNodes(src, nodes) {
+		s.queriesWithoutNewNodes++
+	} else {
+		s.queriesWithoutNewNodes = 0
+	}
+}
+
+// AddTableNodes adds nodes which were found outside of a lookup, e.g. by the local
+// node table. Unlike AddNodes, this doesn't count as a lookup round.
+func (s *Search) AddTableNodes(nodes []*enode.Node) {
+	s.addNodes(nil, nodes)
+}
+
+// addNodes adds nodes to the table. It reports whether any of them was new.
+func (s *Search) addNodes(src *enode.Node, nodes []*enode.Node) bool {
 	var anyNewNode bool
 	for _, n := range nodes {
-		if n.ID() == s.cfg.Self {
+		if s.cfg.isExcluded(n.ID()) {
 			continue
 		}
 		b := s.bucket(n.ID())
@@ -110,57 +324,211 @@ func (s *Search) AddNodes(src *enode.Node, nodes []*enode.Node) {
 		}
 		if b.count() < s.cfg.SearchBucketSize {
 			b.add(n)
+			if src != nil {
+				b.addSource(src.ID())
+			}
 		}
 	}
+	return anyNewNode
+}
 
-	if !anyNewNode {
-		s.queriesWithoutNewNodes++
-	} else {
-		s.queriesWithoutNewNodes = 0
+// LookupTarget returns a target for a node lookup. The target is a random ID in the
+// farthest bucket which contains unasked nodes. When all nodes have been asked, the
+// topic itself is returned.
+func (s *Search) LookupTarget() enode.ID {
+	for _, b := range s.buckets {
+		if len(b.new) > 0 {
+			return enode.RandomID(enode.ID(s.topic), b.dist)
+		}
 	}
+	return enode.ID(s.topic)
 }
 
-// QueryTarget returns a random node to which a topic query should be sent.
+// NextQueryTime returns the time when the next topic query should be sent. It returns
+// Never when there is no node to query.
+//
+// Queries are sent in batches of up to SearchQueryBatchSize. The next batch can
+// start SearchQueryMinDelay after the start of the previous one.
+func (s *Search) NextQueryTime() mclock.AbsTime {
+	if s.QueryTarget() == nil {
+		return Never
+	}
+	now := s.cfg.Clock.Now()
+	if !s.queryStarted || s.batchQueries < s.cfg.SearchQueryBatchSize {
+		return now
+	}
+	next := s.lastQuery.Add(s.cfg.SearchQueryMinDelay)
+	if next < now {
+		return now
+	}
+	return next
+}
+
+// StartQuery should be called when a topic query is sent to the node returned by
+// QueryTarget. The node is not returned by QueryTarget again until its results
+// are added using AddQueryResults.
+func (s *Search) StartQuery() {
+	now := s.cfg.Clock.Now()
+	if !s.queryStarted || now >= s.lastQuery.Add(s.cfg.SearchQueryMinDelay) {
+		s.lastQuery = now
+		s.batchQueries = 0
+	}
+	s.batchQueries++
+	s.queryStarted = true
+	if n := s.QueryTarget(); n != nil {
+		s.bucket(n.ID()).setPending(n)
+	}
+}
+
+// QueryTarget returns the node to which a topic query should be sent. By default,
+// the target is sampled from the unasked nodes of all buckets, with weight
+// 1 / (1 + logdist(topic, node)). Buckets beyond Config.SearchMaxBucketDepth are
+// skipped. Nodes with a query in progress are skipped.
+//
+// When Config.SearchClosestQuery is set, the node is taken from the first bucket
+// with unasked nodes instead, in the order given by Config.SearchBucketOrder.
+// Within the bucket, the node closest to the topic is chosen.
 func (s *Search) QueryTarget() *enode.Node {
-	for _, b := range s.buckets {
-		for _, n := range b.new {
+	limit := s.queryDepthLimit()
+	if !s.cfg.SearchClosestQuery {
+		return s.weightedQueryTarget(limit)
+	}
+	for i := limit; i < len(s.buckets); i++ {
+		b := &s.buckets[len(s.buckets)-1-(i-limit)]
+		if s.cfg.SearchBucketOrder == SearchFarFirst {
+			b = &s.buckets[i]
+		}
+		if n := b.nearestNew(enode.ID(s.topic)); n != nil {
 			return n
 		}
 	}
 	return nil
 }
 
+// weightedQueryTarget samples a query target. The same node is returned until its
+// query is started.
+func (s *Search) weightedQueryTarget(limit int) *enode.Node {
+	if n := s.weightedTarget; n != nil {
+		b := s.bucket(n.ID())
+		if _, ok := b.new[n.ID()]; ok && b.dist <= s.buckets[limit].dist {
+			return n
+		}
+		s.weightedTarget = nil
+	}
+
+	// Candidates are sorted by ID because map iteration order is random, and
+	// sampling must only depend on s.rand.
+	var candidates []*enode.Node
+	for i := limit; i < len(s.buckets); i++ {
+		for _, n := range s.buckets[i].new {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].ID(), candidates[j].ID()
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	var (
+		weights = make([]float64, len(candidates))
+		total   float64
+	)
+	for i, n := range candidates {
+		weights[i] = 1.0 / (1.0 + float64(enode.LogDist(enode.ID(s.topic), n.ID())))
+		total += weights[i]
+	}
+	x := s.rand.Float64() * total
+	s.weightedTarget = candidates[len(candidates)-1]
+	for i, w := range weights {
+		if x < w {
+			s.weightedTarget = candidates[i]
+			break
+		}
+		x -= w
+	}
+	return s.weightedTarget
+}
+
 // AddQueryResults adds the response nodes for a topic query to the table.
 func (s *Search) AddQueryResults(from *enode.Node, results []*enode.Node) {
 	b := s.bucket(from.ID())
+	if _, ok := b.asked[from.ID()]; !ok {
+		s.askedOrder = append(s.askedOrder, from.ID())
+	}
 	b.setAsked(from)
 
+	if s.cfg.SearchAuditLog {
+		for _, n := range results {
+			dist := enode.LogDist(enode.ID(s.topic), n.ID())
+			s.cfg.Log.Trace("Topic query result", "topic", s.topic, "from", from.ID(), "result", n.ID(), "dist", dist)
+		}
+	}
 	for _, n := range results {
-		if n.ID() == s.cfg.Self {
+		if b.numResults >= s.cfg.SearchBucketResultCap {
+			// Limit the number of results from a single bucket, so nodes close to the
+			// topic cannot flood the result buffer.
+			break
+		}
+		if s.cfg.isSelf(n.ID()) {
 			continue
 		}
-		s.cfg.Log.Debug("Added topic search result", "topic", s.topic, "fromid", from.ID(), "rid", n.ID())
+		if _, ok := s.seen[n.ID()]; ok {
+			continue // already returned by another query
+		}
+		if s.resultLen == len(s.resultBuffer) {
+			// The node isn't marked seen, so it can still be returned when
+			// another query finds it later.
+			s.droppedResults++
+			continue
+		}
+		s.markSeen(n.ID())
+		s.cfg.Log.Debug("Added topic search result", "topic", s.topic, "nodeID", n.ID(), "src", from.ID())
 		b.numResults++
 		s.numResults++
-		s.resultBuffer = append(s.resultBuffer, n)
+		s.resultBuffer[(s.resultHead+s.resultLen)%len(s.resultBuffer)] = n
+		s.resultLen++
+	}
+}
+
+// markSeen adds id to the set of seen results. It returns false if id was
+// already present. When the set grows beyond SearchDedupeWindowSize, the
+// oldest half of the entries is forgotten.
+func (s *Search) markSeen(id enode.ID) bool {
+	if _, ok := s.seen[id]; ok {
+		return false
 	}
+	s.seen[id] = struct{}{}
+	s.seenOrder = append(s.seenOrder, id)
+
+	if len(s.seenOrder) > s.cfg.SearchDedupeWindowSize {
+		evict := len(s.seenOrder) / 2
+		for _, old := range s.seenOrder[:evict] {
+			delete(s.seen, old)
+		}
+		s.seenOrder = append(s.seenOrder[:0], s.seenOrder[evict:]...)
+	}
+	return true
 }
 
 // PeekResult returns a node from the result set.
 // When no result is available, it returns nil.
 func (s *Search) PeekResult() *enode.Node {
-	if len(s.resultBuffer) > 0 {
-		return s.resultBuffer[0]
+	if s.resultLen > 0 {
+		return s.resultBuffer[s.resultHead]
 	}
 	return nil
 }
 
 // PopResult removes a result node.
 func (s *Search) PopResult() {
-	if len(s.resultBuffer) == 0 {
+	if s.resultLen == 0 {
 		panic("PopResult with len(results) == 0")
 	}
-	s.resultBuffer = append(s.resultBuffer[:0], s.resultBuffer[1:]...)
+	s.resultBuffer[s.resultHead] = nil
+	s.resultHead = (s.resultHead + 1) % len(s.resultBuffer)
+	s.resultLen--
 }
 
 func (s *Search) bucket(id enode.ID) *searchBucket {
@@ -173,12 +541,20 @@ func (s *Search) bucket(id enode.ID) *searchBucket {
 
 func (b *searchBucket) contains(id enode.ID) bool {
 	_, inNew := b.new[id]
+	_, inPending := b.pending[id]
 	_, inAsked := b.asked[id]
-	return inNew || inAsked
+	_, inRestored := b.restored[id]
+	return inNew || inPending || inAsked || inRestored
 }
 
 func (b *searchBucket) count() int {
-	return len(b.new) + len(b.asked)
+	return len(b.new) + len(b.pending) + len(b.asked)
+}
+
+// hasUnasked reports whether the bucket contains nodes which haven't answered
+// a query yet.
+func (b *searchBucket) hasUnasked() bool {
+	return len(b.new) > 0 || len(b.pending) > 0
 }
 
 func (b *searchBucket) add(n *enode.Node) {
@@ -186,12 +562,56 @@ func (b *searchBucket) add(n *enode.Node) {
 	if _, inAsked := b.asked[id]; inAsked {
 		return
 	}
+	if _, inPending := b.pending[id]; inPending {
+		return
+	}
+	if _, ok := b.restored[id]; ok {
+		delete(b.restored, id)
+		b.asked[id] = n
+		return
+	}
 	b.new[id] = newer(b.new[id], n)
+	b.nearest = nil
+}
+
+// addSource records that the node with the given ID contributed to the bucket.
+func (b *searchBucket) addSource(id enode.ID) {
+	if b.sourceDiversity >= searchBucketSourceLimit {
+		return
+	}
+	if _, ok := b.sources[id]; ok {
+		return
+	}
+	if b.sources == nil {
+		b.sources = make(map[enode.ID]struct{})
+	}
+	b.sources[id] = struct{}{}
+	b.sourceDiversity++
+}
+
+func (b *searchBucket) setPending(n *enode.Node) {
+	b.pending[n.ID()] = n
+	delete(b.new, n.ID())
+	b.nearest = nil
 }
 
 func (b *searchBucket) setAsked(n *enode.Node) {
-	b.asked[n.ID()] = struct{}{}
+	b.asked[n.ID()] = n
 	delete(b.new, n.ID())
+	delete(b.pending, n.ID())
+	b.nearest = nil
+}
+
+// nearestNew returns the unasked node closest to target.
+func (b *searchBucket) nearestNew(target enode.ID) *enode.Node {
+	if b.nearest == nil {
+		for _, n := range b.new {
+			if b.nearest == nil || enode.DistCmp(target, n.ID(), b.nearest.ID()) < 0 {
+				b.nearest = n
+			}
+		}
+	}
+	return b.nearest
 }
 
 func newer(n1 *enode.Node, n2 *enode.Node) *enode.Node {
@@ -0,0 +1,74 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// searchAskedEnc is the persisted form of the asked set of a Search.
+type searchAskedEnc struct {
+	Topic TopicID
+	IDs   []enode.ID // oldest first
+}
+
+// MarshalAskedSet encodes the IDs of nodes which have been asked by the search.
+// When more than Config.SearchMaxPersistedAsked nodes were asked, only the most
+// recently asked ones are stored.
+func (s *Search) MarshalAskedSet() ([]byte, error) {
+	ids := s.askedOrder
+	if len(ids) > s.cfg.SearchMaxPersistedAsked {
+		ids = ids[len(ids)-s.cfg.SearchMaxPersistedAsked:]
+	}
+	return rlp.EncodeToBytes(&searchAskedEnc{Topic: s.topic, IDs: ids})
+}
+
+// UnmarshalAskedSet restores an asked set created by MarshalAskedSet. Nodes in
+// the set are not queried again by this search. Since only IDs are stored, nodes
+// which aren't in the search table yet are marked as asked when they are added.
+func (s *Search) UnmarshalAskedSet(data []byte) error {
+	var enc searchAskedEnc
+	if err := rlp.DecodeBytes(data, &enc); err != nil {
+		return err
+	}
+	if enc.Topic != s.topic {
+		return fmt.Errorf("topic mismatch: have %s, want %s", enc.Topic.Hex(), s.topic.Hex())
+	}
+
+	for _, id := range enc.IDs {
+		if s.cfg.isExcluded(id) {
+			continue
+		}
+		b := s.bucket(id)
+		switch {
+		case b.new[id] != nil:
+			b.setAsked(b.new[id])
+		case b.contains(id):
+			continue
+		default:
+			if b.restored == nil {
+				b.restored = make(map[enode.ID]struct{})
+			}
+			b.restored[id] = struct{}{}
+		}
+		s.askedOrder = append(s.askedOrder, id)
+	}
+	return nil
+}
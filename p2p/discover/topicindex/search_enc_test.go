@@ -0,0 +1,117 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package topicindex
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// This test checks that the asked set survives MarshalAskedSet/UnmarshalAskedSet.
+func TestSearchAskedSetRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	s := NewSearch(topic1, cfg)
+	nodes := generateNodes(40)
+	s.AddNodes(nil, nodes)
+
+	// Ask some of the nodes.
+	asked := make(map[enode.ID]bool)
+	for i := 0; i < 10; i++ {
+		n := s.QueryTarget()
+		if n == nil {
+			t.Fatal("no query target")
+		}
+		s.AddQueryResults(n, nil)
+		asked[n.ID()] = true
+	}
+	data, err := s.MarshalAskedSet()
+	if err != nil {
+		t.Fatal("MarshalAskedSet failed:", err)
+	}
+
+	// Restore into a new search. Nodes added before and after restoring
+	// must be treated as asked.
+	s2 := NewSearch(topic1, cfg)
+	s2.AddNodes(nil, nodes[:20])
+	if err := s2.UnmarshalAskedSet(data); err != nil {
+		t.Fatal("UnmarshalAskedSet failed:", err)
+	}
+	s2.AddNodes(nil, nodes[20:])
+	for n := s2.QueryTarget(); n != nil; n = s2.QueryTarget() {
+		if asked[n.ID()] {
+			t.Fatalf("restored search queries asked node %v", n.ID())
+		}
+		s2.AddQueryResults(n, nil)
+	}
+	if got, want := len(s2.AskedNodes()), s.Stats().Asked+s.Stats().Unasked; got != want {
+		t.Fatalf("wrong number of asked nodes after restore: got %d, want %d", got, want)
+	}
+
+	// Encoding the restored search yields the same set.
+	data2, err := s2.MarshalAskedSet()
+	if err != nil {
+		t.Fatal("MarshalAskedSet failed:", err)
+	}
+	s3 := NewSearch(topic1, cfg)
+	if err := s3.UnmarshalAskedSet(data2); err != nil {
+		t.Fatal("UnmarshalAskedSet failed:", err)
+	}
+	if len(s3.askedOrder) != len(s2.askedOrder) {
+		t.Fatalf("wrong number of IDs after second round trip: %d, want %d", len(s3.askedOrder), len(s2.askedOrder))
+	}
+
+	// Loading into a search for another topic fails.
+	if err := NewSearch(topic2, cfg).UnmarshalAskedSet(data); err == nil {
+		t.Fatal("no error for topic mismatch")
+	}
+}
+
+// This test checks that MarshalAskedSet stores only the most recently asked nodes
+// when the set is larger than SearchMaxPersistedAsked.
+func TestSearchAskedSetLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SearchMaxPersistedAsked = 5
+	s := NewSearch(topic1, cfg)
+	s.AddNodes(nil, generateNodes(30))
+
+	var order []enode.ID
+	for n := s.QueryTarget(); n != nil; n = s.QueryTarget() {
+		s.AddQueryResults(n, nil)
+		order = append(order, n.ID())
+	}
+	if len(order) <= cfg.SearchMaxPersistedAsked {
+		t.Fatalf("only %d nodes asked", len(order))
+	}
+	data, err := s.MarshalAskedSet()
+	if err != nil {
+		t.Fatal("MarshalAskedSet failed:", err)
+	}
+	s2 := NewSearch(topic1, cfg)
+	if err := s2.UnmarshalAskedSet(data); err != nil {
+		t.Fatal("UnmarshalAskedSet failed:", err)
+	}
+	want := order[len(order)-cfg.SearchMaxPersistedAsked:]
+	if len(s2.askedOrder) != len(want) {
+		t.Fatalf("restored %d IDs, want %d", len(s2.askedOrder), len(want))
+	}
+	for i := range want {
+		if s2.askedOrder[i] != want[i] {
+			t.Fatalf("restored ID %d is %v, want %v", i, s2.askedOrder[i], want[i])
+		}
+	}
+}
@@ -17,18 +17,48 @@
 package topicindex
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 )
 
-// func TestSearchLookups(t *testing.T) {
-// 	config := testConfig(t)
-// 	s := NewSearch(topic1, config)
-//
-// 	t.Log(s.LookupTarget())
-// }
+// This test checks that LookupTarget moves through the buckets which contain
+// unasked nodes, starting with the farthest one.
+func TestSearchLookupTarget(t *testing.T) {
+	config := testConfig(t)
+	s := NewSearch(topic1, config)
+	target := enode.ID(s.topic)
+
+	if lt := s.LookupTarget(); lt != target {
+		t.Fatalf("empty search returned lookup target %v, want topic", lt)
+	}
+
+	dists := []int{256, 250, 240}
+	for _, d := range dists {
+		s.AddNodes(nil, nodesAtDistance(target, d, 3))
+	}
+	for _, d := range dists {
+		if ld := enode.LogDist(target, s.LookupTarget()); ld != d {
+			t.Fatalf("lookup target at distance %d, want %d", ld, d)
+		}
+		// Ask all nodes in the bucket.
+		b := s.bucket(enode.RandomID(target, d))
+		for _, n := range b.new {
+			s.AddQueryResults(n, nil)
+		}
+	}
+	if lt := s.LookupTarget(); lt != target {
+		t.Fatalf("lookup target %v after asking all nodes, want topic", lt)
+	}
+}
 
 // This checks that search buckets are filled correctly
 // with nodes at various distances.
@@ -62,6 +92,144 @@ func TestSearchBuckets(t *testing.T) {
 	}
 }
 
+// This test checks that Stats reports the number of distinct sources per bucket.
+func TestSearchSourceDiversity(t *testing.T) {
+	config := testConfig(t)
+	config.SearchBucketSize = 2 * searchBucketSourceLimit
+	s := NewSearch(topic1, config)
+	target := enode.ID(s.topic)
+
+	// Bucket i (distance 256-i) receives nodes from sources[i] distinct sources.
+	sources := []int{1, 2, 5, searchBucketSourceLimit + 3}
+	for i, n := range sources {
+		for _, src := range generateNodes(n) {
+			s.AddNodes(src, nodesAtDistance(target, 256-i, 1))
+			// Adding more nodes from the same source doesn't change the count.
+			s.AddNodes(src, nodesAtDistance(target, 256-i, 1))
+		}
+	}
+	// Nodes without a source are not counted.
+	s.AddNodes(nil, nodesAtDistance(target, 256, 1))
+
+	st := s.Stats()
+	if len(st.BucketSourceDiversity) != searchTableDepth {
+		t.Fatalf("wrong BucketSourceDiversity length %d", len(st.BucketSourceDiversity))
+	}
+	for i, n := range sources {
+		want := n
+		if want > searchBucketSourceLimit {
+			want = searchBucketSourceLimit
+		}
+		if got := st.BucketSourceDiversity[i]; got != want {
+			t.Errorf("bucket %d: source diversity %d, want %d", i, got, want)
+		}
+	}
+	if got := st.BucketSourceDiversity[len(sources)]; got != 0 {
+		t.Errorf("empty bucket has source diversity %d", got)
+	}
+}
+
+// This checks the completion conditions of Search.IsDone.
+func TestSearchIsDone(t *testing.T) {
+	var (
+		far    = nodeAtDistance(enode.ID(topic1), 256, intIP(1))
+		close1 = nodeAtDistance(enode.ID(topic1), 240, intIP(2))
+		close2 = nodeAtDistance(enode.ID(topic1), 241, intIP(3))
+	)
+
+	t.Run("ClosestBucketsAsked", func(t *testing.T) {
+		config := testConfig(t)
+		config.SearchBucketSize = 2
+		s := NewSearch(topic1, config)
+		s.AddNodes(nil, []*enode.Node{far, close1, close2})
+
+		s.AddQueryResults(close1, nil)
+		if s.IsDone() {
+			t.Fatal("done with unasked node in closest buckets")
+		}
+		s.AddQueryResults(close2, nil)
+		if !s.IsDone() {
+			t.Fatal("not done after asking all nodes in closest buckets")
+		}
+	})
+
+	t.Run("MaxResults", func(t *testing.T) {
+		config := testConfig(t)
+		config.SearchMaxResults = 3
+		s := NewSearch(topic1, config)
+		s.AddNodes(nil, []*enode.Node{far, close1})
+
+		s.AddQueryResults(close1, nodesAtDistance(enode.ID(topic1), 200, 3))
+		if s.IsDone() {
+			t.Fatal("done with results in buffer")
+		}
+		for s.PeekResult() != nil {
+			s.PopResult()
+		}
+		if !s.IsDone() {
+			t.Fatal("not done after SearchMaxResults results")
+		}
+	})
+
+	t.Run("MaxEmptyRounds", func(t *testing.T) {
+		config := testConfig(t)
+		config.SearchMaxEmptyRounds = 3
+		config.SearchMinLookupRounds = 1
+		s := NewSearch(topic1, config)
+		s.AddNodes(nil, []*enode.Node{far})
+		s.AddQueryResults(far, nil)
+
+		for i := 0; i < config.SearchMaxEmptyRounds; i++ {
+			if s.IsDone() {
+				t.Fatalf("done after %d empty rounds", i)
+			}
+			s.AddNodes(nil, []*enode.Node{far})
+		}
+		if !s.IsDone() {
+			t.Fatal("not done after SearchMaxEmptyRounds empty rounds")
+		}
+	})
+
+	t.Run("MinLookupRounds", func(t *testing.T) {
+		// Lookups in an empty network don't find any nodes.
+		config := testConfig(t)
+		config.SearchMaxEmptyRounds = 2
+		config.SearchMinLookupRounds = 5
+		s := NewSearch(topic1, config)
+
+		for i := 0; i < config.SearchMinLookupRounds; i++ {
+			if s.IsDone() {
+				t.Fatalf("done after %d lookup rounds", i)
+			}
+			s.AddNodes(nil, nil)
+		}
+		if !s.IsDone() {
+			t.Fatal("not done after SearchMinLookupRounds empty rounds")
+		}
+	})
+
+	t.Run("MinResults", func(t *testing.T) {
+		config := testConfig(t)
+		config.SearchMinResults = 3
+		s := NewSearch(topic1, config)
+		s.AddNodes(nil, []*enode.Node{far, close1, close2})
+
+		// All nodes are asked, and many lookups yield nothing new.
+		s.AddQueryResults(far, nil)
+		s.AddQueryResults(close1, nodesAtDistance(enode.ID(topic1), 200, 2))
+		s.AddQueryResults(close2, nil)
+		for i := 0; i < 10*config.WithDefaults().SearchMinLookupRounds; i++ {
+			s.AddNodes(nil, nil)
+		}
+		for s.PeekResult() != nil {
+			s.PopResult()
+		}
+		if s.IsDone() {
+			t.Fatal("done with fewer than SearchMinResults results")
+		}
+	})
+}
+
 func sbContainsAll(b searchBucket, nodes []*enode.Node) bool {
 	for _, n := range nodes {
 		if !b.contains(n.ID()) {
@@ -71,6 +239,253 @@ func sbContainsAll(b searchBucket, nodes []*enode.Node) bool {
 	return true
 }
 
+// This test checks that a search seeded with known nodes can send its first
+// query right away, while a fresh search has nothing to query.
+func TestSearchFromNodes(t *testing.T) {
+	clock := new(mclock.Simulated)
+	config := testConfig(t)
+	config.Clock = clock
+
+	var nodes []*enode.Node
+	for d := 256; len(nodes) < 100; d-- {
+		nodes = append(nodes, nodesAtDistance(enode.ID(topic1), d, 5)...)
+	}
+
+	cold := NewSearch(topic1, config)
+	if next := cold.NextQueryTime(); !IsNever(next) {
+		t.Fatalf("cold search has next query time %v", next)
+	}
+	if n := cold.QueryTarget(); n != nil {
+		t.Fatal("cold search has query target")
+	}
+
+	warm := NewSearchFromNodes(topic1, config, nodes)
+	if next := warm.NextQueryTime(); next > clock.Now() {
+		t.Fatalf("warm search has next query time %v, want <= %v", next, clock.Now())
+	}
+	if n := warm.QueryTarget(); n == nil {
+		t.Fatal("warm search has no query target")
+	}
+	if st := warm.Stats(); st.Unasked != 100 {
+		t.Fatalf("warm search has %d unasked nodes, want 100", st.Unasked)
+	}
+}
+
+func TestSearchFromPrior(t *testing.T) {
+	config := testConfig(t)
+	prior := NewSearch(topic1, config)
+	nodes := nodesAtDistance(enode.ID(topic1), 250, 3)
+	prior.AddNodes(nil, nodes)
+	asked := prior.QueryTarget()
+	prior.AddQueryResults(asked, nil)
+
+	if got := prior.AskedNodes(); len(got) != 1 || got[0] != asked {
+		t.Fatalf("wrong asked nodes %v", got)
+	}
+
+	// By default, all nodes of the prior search can be queried again.
+	s := NewSearchFromPrior(prior, config)
+	if s.Topic() != prior.Topic() {
+		t.Fatal("wrong topic")
+	}
+	if st := s.Stats(); st.Asked != 0 || st.Unasked != len(nodes) {
+		t.Fatalf("wrong stats after warm restart: %+v", st)
+	}
+
+	// With SearchColdStart, only the unasked nodes are carried over.
+	config.SearchColdStart = true
+	s = NewSearchFromPrior(prior, config)
+	if st := s.Stats(); st.Asked != 0 || st.Unasked != len(nodes)-1 {
+		t.Fatalf("wrong stats after cold restart: %+v", st)
+	}
+	// The asked node can still be added again.
+	s.AddNodes(nil, []*enode.Node{asked})
+	if st := s.Stats(); st.Unasked != len(nodes) {
+		t.Fatalf("asked node not re-added: %+v", st)
+	}
+}
+
+// This test checks that queries are started in batches of SearchQueryBatchSize,
+// and that nodes with a query in progress are not chosen again.
+func TestSearchQueryBatch(t *testing.T) {
+	clock := new(mclock.Simulated)
+	config := testConfig(t)
+	config.Clock = clock
+	config.SearchQueryBatchSize = 2
+	config.SearchQueryMinDelay = time.Second
+	s := NewSearchFromNodes(topic1, config, nodesAtDistance(enode.ID(topic1), 250, 3))
+
+	// The first batch can be sent right away.
+	started := make(map[enode.ID]*enode.Node)
+	for i := 0; i < 2; i++ {
+		if next := s.NextQueryTime(); next != clock.Now() {
+			t.Fatalf("query %d: next query time %v, want %v", i, next, clock.Now())
+		}
+		n := s.QueryTarget()
+		if started[n.ID()] != nil {
+			t.Fatalf("query %d: node %v chosen again", i, n.ID())
+		}
+		started[n.ID()] = n
+		s.StartQuery()
+	}
+	if st := s.Stats(); st.Asked != 0 || st.Unasked != 3 {
+		t.Fatalf("wrong stats with queries in progress: %+v", st)
+	}
+
+	// The next batch starts after SearchQueryMinDelay.
+	if next := s.NextQueryTime(); next != clock.Now().Add(config.SearchQueryMinDelay) {
+		t.Fatalf("wrong next query time %v after full batch", next)
+	}
+	clock.Run(config.SearchQueryMinDelay)
+	if n := s.QueryTarget(); started[n.ID()] != nil {
+		t.Fatalf("node %v chosen again", n.ID())
+	}
+	s.StartQuery()
+	if next := s.NextQueryTime(); !IsNever(next) {
+		t.Fatalf("next query time %v with all nodes started", next)
+	}
+	if s.IsDone() {
+		t.Fatal("search done with queries in progress")
+	}
+
+	// Results move the nodes to the asked set.
+	for _, n := range started {
+		s.AddQueryResults(n, nil)
+	}
+	if st := s.Stats(); st.Asked != 2 || st.Unasked != 1 {
+		t.Fatalf("wrong stats after results: %+v", st)
+	}
+}
+
+// This test checks that search progress increases as nodes are asked.
+func TestSearchProgress(t *testing.T) {
+	config := testConfig(t)
+	config.SearchBucketSize = 4
+	s := NewSearch(topic1, config)
+
+	var nodes []*enode.Node
+	for d := 256; d > 256-searchTableDepth; d -= 5 {
+		nodes = append(nodes, nodesAtDistance(enode.ID(topic1), d, 4)...)
+	}
+	s.AddNodes(nil, nodes)
+	if p := s.Progress(); p != 0 {
+		t.Fatalf("progress %f before any query", p)
+	}
+
+	var (
+		last    float64
+		queries int
+	)
+	for n := s.QueryTarget(); n != nil; n = s.QueryTarget() {
+		s.AddQueryResults(n, nodesAtDistance(n.ID(), 200, 1))
+		queries++
+		p := s.Progress()
+		if p <= last || p > 1 {
+			t.Fatalf("progress %f after query %d, previous %f", p, queries, last)
+		}
+		last = p
+	}
+	want := float64(len(nodes)) / float64(searchTableDepth*config.SearchBucketSize)
+	st := s.Stats()
+	if st.Progress != want || st.Asked != len(nodes) || st.Unasked != 0 {
+		t.Fatalf("wrong stats %+v, want progress %f", st, want)
+	}
+	if st.Results != s.ResultCount() || st.Results != queries {
+		t.Fatalf("wrong result count %d, want %d", st.Results, queries)
+	}
+}
+
+func TestSearchBucketOrder(t *testing.T) {
+	var (
+		far  = nodeAtDistance(enode.ID(topic1), 256, intIP(1))
+		near = nodeAtDistance(enode.ID(topic1), 230, intIP(2))
+	)
+	for _, test := range []struct {
+		order SearchBucketOrder
+		want  *enode.Node
+	}{
+		{SearchCloseFirst, near},
+		{SearchFarFirst, far},
+	} {
+		config := testConfig(t)
+		config.SearchClosestQuery = true
+		config.SearchBucketOrder = test.order
+		s := NewSearch(topic1, config)
+		s.AddNodes(nil, []*enode.Node{far, near})
+		if n := s.QueryTarget(); n != test.want {
+			t.Errorf("order %d: wrong query target %v", test.order, n.ID())
+		}
+	}
+}
+
+// This benchmark measures the number of queries needed to find the first result
+// when only nodes close to the topic have results.
+// This benchmark compares the result ring buffer with removal from the front of
+// a slice, for 1000 results. The buffers are refilled directly, so only the
+// removal of results is measured.
+func BenchmarkSearchResultBuffer(b *testing.B) {
+	const numResults = 1000
+	nodes := nodesAtDistance(enode.ID(topic1), 200, numResults)
+
+	b.Run("ring", func(b *testing.B) {
+		s := NewSearch(topic1, Config{SearchMaxResults: numResults})
+		for i := 0; i < b.N; i++ {
+			copy(s.resultBuffer, nodes)
+			s.resultHead, s.resultLen = 0, numResults
+			for s.PeekResult() != nil {
+				s.PopResult()
+			}
+		}
+	})
+	b.Run("slice", func(b *testing.B) {
+		buf := make([]*enode.Node, 0, numResults)
+		for i := 0; i < b.N; i++ {
+			buf = append(buf[:0], nodes...)
+			for len(buf) > 0 {
+				buf = append(buf[:0], buf[1:]...)
+			}
+		}
+	})
+}
+
+func BenchmarkSearchFirstResult(b *testing.B) {
+	var nodes []*enode.Node
+	for d := 256; d > 256-searchTableDepth; d-- {
+		nodes = append(nodes, nodeAtDistance(enode.ID(topic1), d, intIP(d)))
+	}
+	results := nodesAtDistance(enode.ID(topic1), 200, 1)
+
+	configs := []struct {
+		name   string
+		config Config
+	}{
+		{"far-first", Config{SearchClosestQuery: true, SearchBucketOrder: SearchFarFirst}},
+		{"close-first", Config{SearchClosestQuery: true, SearchBucketOrder: SearchCloseFirst}},
+		{"weighted", Config{}},
+	}
+	for _, bc := range configs {
+		config := bc.config
+		config.SearchMaxBucketDepth = searchTableDepth
+		b.Run(bc.name, func(b *testing.B) {
+			queries := 0
+			for i := 0; i < b.N; i++ {
+				s := NewSearch(topic1, config)
+				s.AddNodes(nil, nodes)
+				for s.PeekResult() == nil {
+					n := s.QueryTarget()
+					queries++
+					if enode.LogDist(enode.ID(topic1), n.ID()) < 226 {
+						s.AddQueryResults(n, results)
+					} else {
+						s.AddQueryResults(n, nil)
+					}
+				}
+			}
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
 // This checks (de)queueing of topic search results.
 func TestSearchResultsTracking(t *testing.T) {
 	config := testConfig(t)
@@ -90,3 +505,391 @@ func TestSearchResultsTracking(t *testing.T) {
 		s.PopResult()
 	}
 }
+
+// This test checks that the number of results accepted from a single bucket is limited.
+func TestSearchBucketResultCap(t *testing.T) {
+	config := testConfig(t)
+	s := NewSearch(topic1, config)
+
+	var (
+		src   = nodeAtDistance(enode.ID(topic1), 250, intIP(1))
+		nodes = nodesAtDistance(src.ID(), 256, 200)
+		limit = config.WithDefaults().SearchBucketResultCap
+	)
+	s.AddQueryResults(src, nodes)
+
+	var n int
+	for ; s.PeekResult() != nil; n++ {
+		s.PopResult()
+	}
+	if n != limit {
+		t.Fatalf("got %d results, want %d", n, limit)
+	}
+
+	// Further results from the same bucket are rejected.
+	s.AddQueryResults(src, nodesAtDistance(src.ID(), 256, 10))
+	if s.PeekResult() != nil {
+		t.Fatal("result accepted after bucket cap was reached")
+	}
+}
+
+// This test checks the result ring buffer. Results which don't fit are dropped,
+// and can be returned by a later query.
+func TestSearchResultBufferFull(t *testing.T) {
+	config := testConfig(t)
+	config.SearchMaxResults = 4
+	s := NewSearch(topic1, config)
+
+	var (
+		srcs  = nodesAtDistance(enode.ID(topic1), 250, 3)
+		nodes = nodesAtDistance(enode.ID(topic1), 200, 7)
+	)
+	// Move the head of the buffer, so the next results wrap around.
+	s.AddQueryResults(srcs[0], nodes[:3])
+	s.PopResult()
+	s.PopResult()
+
+	// Only three of the four results fit.
+	s.AddQueryResults(srcs[1], nodes[3:7])
+	if st := s.Stats(); st.DroppedResults != 1 {
+		t.Fatalf("DroppedResults is %d, want 1", st.DroppedResults)
+	}
+	for i, want := range nodes[2:6] {
+		if n := s.PeekResult(); n != want {
+			t.Fatalf("wrong result %d: got %v, want %v", i, n, want)
+		}
+		s.PopResult()
+	}
+	if s.PeekResult() != nil {
+		t.Fatal("buffer not empty")
+	}
+
+	// The dropped result is accepted when it's found again.
+	s.AddQueryResults(srcs[2], nodes[6:])
+	if n := s.PeekResult(); n != nodes[6] {
+		t.Fatalf("dropped result not returned by later query, got %v", n)
+	}
+}
+
+// This checks that results returned by multiple queries are deduplicated.
+func TestSearchResultsDedup(t *testing.T) {
+	var (
+		srcs  = nodesAtDistance(enode.ID(topic1), 250, 3)
+		nodes = nodesAtDistance(enode.ID(topic1), 200, 5)
+	)
+	type query struct {
+		src     int
+		results []*enode.Node
+	}
+	tests := []struct {
+		name       string
+		windowSize int
+		queries    []query
+		want       []*enode.Node
+	}{
+		{
+			name: "distinct",
+			queries: []query{
+				{0, nodes[:2]},
+				{1, nodes[2:4]},
+			},
+			want: nodes[:4],
+		},
+		{
+			name: "same-source",
+			queries: []query{
+				{0, []*enode.Node{nodes[0], nodes[0], nodes[1]}},
+			},
+			want: nodes[:2],
+		},
+		{
+			name: "multiple-sources",
+			queries: []query{
+				{0, nodes[:3]},
+				{1, nodes[1:4]},
+				{2, nodes[2:5]},
+			},
+			want: nodes,
+		},
+		{
+			name:       "window-eviction",
+			windowSize: 4,
+			queries: []query{
+				{0, nodes[:5]},
+				{1, nodes[:1]}, // nodes[0] was evicted, nodes[4] is still known
+				{2, nodes[4:]},
+			},
+			want: append(nodes[:5:5], nodes[0]),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.SearchDedupeWindowSize = test.windowSize
+			s := NewSearch(topic1, config)
+			for _, q := range test.queries {
+				s.AddQueryResults(srcs[q.src], q.results)
+			}
+
+			var got []*enode.Node
+			for n := s.PeekResult(); n != nil; n = s.PeekResult() {
+				got = append(got, n)
+				s.PopResult()
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d results, want %d", len(got), len(test.want))
+			}
+			for i := range got {
+				if got[i].ID() != test.want[i].ID() {
+					t.Fatalf("wrong result %d: got %v, want %v", i, got[i].ID(), test.want[i].ID())
+				}
+			}
+		})
+	}
+}
+
+// This test checks that QueryTarget returns unasked nodes of a bucket in order of
+// their distance to the topic.
+func TestSearchQueryTargetNearest(t *testing.T) {
+	config := testConfig(t)
+	config.SearchClosestQuery = true
+	config.SearchBucketSize = 10
+	s := NewSearch(topic1, config)
+	nodes := nodesAtDistance(enode.ID(topic1), 250, 10)
+	s.AddNodes(nil, nodes)
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return enode.DistCmp(enode.ID(topic1), nodes[i].ID(), nodes[j].ID()) < 0
+	})
+	for i, want := range nodes {
+		n := s.QueryTarget()
+		if n != want {
+			t.Fatalf("query %d: wrong target %v, want %v", i, n.ID(), want.ID())
+		}
+		if s.QueryTarget() != n {
+			t.Fatalf("query %d: target changed without update", i)
+		}
+		s.AddQueryResults(n, nil)
+	}
+	if n := s.QueryTarget(); n != nil {
+		t.Fatalf("got query target %v after all nodes were asked", n.ID())
+	}
+}
+
+func BenchmarkSearchQueryTarget(b *testing.B) {
+	nodes := nodesAtDistance(enode.ID(topic1), 250, 16)
+
+	// In the 'cached' case, the bucket doesn't change between calls.
+	b.Run("cached", func(b *testing.B) {
+		s := NewSearch(topic1, Config{SearchBucketSize: len(nodes)})
+		s.AddNodes(nil, nodes)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.QueryTarget()
+		}
+	})
+	// In the 'invalidated' case, every call follows a change of the bucket.
+	b.Run("invalidated", func(b *testing.B) {
+		s := NewSearch(topic1, Config{SearchBucketSize: len(nodes)})
+		s.AddNodes(nil, nodes)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.AddNodes(nil, nodes[i%len(nodes):i%len(nodes)+1])
+			s.QueryTarget()
+		}
+	})
+}
+
+// This test checks that Config.SearchSeedNodes are available as query targets
+// before any lookup has been performed, even when their bucket is full.
+func TestSearchSeedNodes(t *testing.T) {
+	config := testConfig(t)
+	config.SearchBucketSize = 1
+	seeds := nodesAtDistance(enode.ID(topic1), 256, 2)
+	excluded := nodeAtDistance(enode.ID(topic1), 250, intIP(5))
+	config.SearchSeedNodes = append(seeds, excluded)
+	config.ExcludeIDs = []enode.ID{excluded.ID()}
+	s := NewSearch(topic1, config)
+
+	if n := s.QueryTarget(); n == nil || !sbContainsAll(s.buckets[0], []*enode.Node{n}) {
+		t.Fatal("seed node is not the first query target")
+	}
+	if !sbContainsAll(s.buckets[0], seeds) {
+		t.Fatal("seed nodes missing in bucket[0]")
+	}
+	if s.bucket(excluded.ID()).contains(excluded.ID()) {
+		t.Fatal("excluded seed node was added")
+	}
+	if s.lookupRounds != 0 {
+		t.Fatalf("seeding counted %d lookup rounds", s.lookupRounds)
+	}
+}
+
+// This test checks that nodes added by AddTableNodes don't count as lookup rounds
+// or empty rounds.
+func TestSearchAddTableNodes(t *testing.T) {
+	config := testConfig(t)
+	config.SearchMinLookupRounds = 2
+	config.SearchMaxEmptyRounds = 2
+	s := NewSearch(topic1, config)
+	s.AddNodes(nil, nodesAtDistance(enode.ID(topic1), 256, 1))
+
+	// Add the same node many times. Through AddNodes, this would end the search.
+	n := nodeAtDistance(enode.ID(topic1), 255, intIP(1))
+	for i := 0; i < 5; i++ {
+		s.AddTableNodes([]*enode.Node{n})
+	}
+	if s.lookupRounds != 1 {
+		t.Fatalf("wrong lookupRounds %d after table nodes, want 1", s.lookupRounds)
+	}
+	if s.queriesWithoutNewNodes != 0 {
+		t.Fatalf("table nodes counted %d empty rounds", s.queriesWithoutNewNodes)
+	}
+	if !s.bucket(n.ID()).contains(n.ID()) {
+		t.Fatal("table node not added")
+	}
+}
+
+// This test checks the default query target sampling, which is weighted by
+// distance.
+func TestSearchWeightedQuery(t *testing.T) {
+	config := testConfig(t)
+	config.SearchBucketSize = 10
+
+	// Sampling is deterministic for a topic.
+	nodes := append(nodesAtDistance(enode.ID(topic1), 256, 10), nodesAtDistance(enode.ID(topic1), 240, 5)...)
+	s1, s2 := NewSearch(topic1, config), NewSearch(topic1, config)
+	s1.AddNodes(nil, nodes)
+	s2.AddNodes(nil, nodes)
+	for i := range nodes {
+		n := s1.QueryTarget()
+		if n == nil || n != s2.QueryTarget() {
+			t.Fatalf("query %d: targets differ", i)
+		}
+		if s1.QueryTarget() != n {
+			t.Fatalf("query %d: target changed without update", i)
+		}
+		s1.StartQuery()
+		s2.StartQuery()
+		s1.AddQueryResults(n, nil)
+		s2.AddQueryResults(n, nil)
+	}
+	if n := s1.QueryTarget(); n != nil {
+		t.Fatalf("got query target %v after all nodes were asked", n.ID())
+	}
+
+	// A node close to the topic is preferred over many far nodes.
+	closeFirst := 0
+	for i := 0; i < 100; i++ {
+		var topic TopicID
+		binary.BigEndian.PutUint64(topic[:], uint64(i))
+		s := NewSearch(topic, config)
+		near := nodeAtDistance(enode.ID(topic), 1, intIP(1))
+		s.AddNodes(nil, nodesAtDistance(enode.ID(topic), 256, 10))
+		s.AddNodes(nil, []*enode.Node{near})
+		if s.QueryTarget() == near {
+			closeFirst++
+		}
+	}
+	if closeFirst < 80 {
+		t.Fatalf("close node was the first target in %d of 100 searches", closeFirst)
+	}
+}
+
+// This test checks that nodes beyond SearchMaxBucketDepth are tracked, but not
+// queried.
+func TestSearchMaxBucketDepth(t *testing.T) {
+	config := testConfig(t)
+	config.SearchMaxBucketDepth = 2
+	s := NewSearch(topic1, config)
+
+	var (
+		close  = nodesAtDistance(enode.ID(topic1), 240, 2)
+		middle = nodesAtDistance(enode.ID(topic1), 250, 2)
+		far    = nodesAtDistance(enode.ID(topic1), 256, 2)
+	)
+	s.AddNodes(nil, far)
+	s.AddNodes(nil, middle)
+	s.AddNodes(nil, close)
+	if !sbContainsAll(s.buckets[0], far) {
+		t.Fatal("far nodes not tracked in bucket[0]")
+	}
+
+	queried := make(map[enode.ID]bool)
+	for n := s.QueryTarget(); n != nil; n = s.QueryTarget() {
+		queried[n.ID()] = true
+		s.StartQuery()
+		s.AddQueryResults(n, nil)
+	}
+	for _, n := range append(close, middle...) {
+		if !queried[n.ID()] {
+			t.Errorf("node at distance %d not queried", enode.LogDist(enode.ID(topic1), n.ID()))
+		}
+	}
+	for _, n := range far {
+		if queried[n.ID()] {
+			t.Error("node beyond SearchMaxBucketDepth was queried")
+		}
+	}
+	if st := s.Stats(); st.Unasked != len(far) {
+		t.Errorf("wrong unasked count %d, want %d", st.Unasked, len(far))
+	}
+	// Lookups without new nodes end the search, even though far nodes are unasked.
+	for i := 0; i < s.cfg.SearchMinLookupRounds; i++ {
+		s.AddNodes(nil, nil)
+	}
+	if !s.IsDone() {
+		t.Error("search not done after all nodes within depth limit were asked")
+	}
+}
+
+// This test checks that query results are logged with Config.SearchAuditLog.
+func TestSearchAuditLog(t *testing.T) {
+	run := func(audit bool) (from *enode.Node, results []*enode.Node, logged []map[string]interface{}) {
+		var buf bytes.Buffer
+		logger := log.New()
+		logger.SetHandler(log.StreamHandler(&buf, log.JSONFormat()))
+
+		config := testConfig(t)
+		config.Log = logger
+		config.SearchAuditLog = audit
+		s := NewSearch(topic1, config)
+		from = nodeAtDistance(enode.ID(topic1), 255, intIP(1))
+		s.AddNodes(nil, []*enode.Node{from})
+		results = nodesAtDistance(enode.ID(topic1), 250, 3)
+		s.AddQueryResults(from, results)
+
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var rec map[string]interface{}
+			if err := json.Unmarshal(line, &rec); err != nil {
+				t.Fatalf("invalid JSON log line %q: %v", line, err)
+			}
+			if rec["msg"] == "Topic query result" {
+				logged = append(logged, rec)
+			}
+		}
+		return from, results, logged
+	}
+
+	if _, _, logged := run(false); len(logged) != 0 {
+		t.Fatalf("%d results logged with audit log disabled", len(logged))
+	}
+	from, results, logged := run(true)
+	if len(logged) != len(results) {
+		t.Fatalf("%d results logged, want %d", len(logged), len(results))
+	}
+	for i, rec := range logged {
+		want := map[string]interface{}{
+			"topic":  topic1.String(),
+			"from":   from.ID().String(),
+			"result": results[i].ID().String(),
+			"dist":   float64(250),
+		}
+		for key, value := range want {
+			if rec[key] != value {
+				t.Errorf("result %d: field %q is %v, want %v", i, key, rec[key], value)
+			}
+		}
+	}
+}
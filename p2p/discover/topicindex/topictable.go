@@ -38,6 +38,8 @@ const topicTableWaitTimeFloor = 50 * time.Millisecond
 
 // TopicTable holds node registrations.
 type TopicTable struct {
+	// Registrations are inserted at the front of these lists, so the back
+	// holds the registration which expires first.
 	all *list.List
 	reg map[TopicID]*list.List
 	wt  waitTimeState
@@ -62,7 +64,7 @@ func NewTopicTable(hostID enode.ID, cfg Config) *TopicTable {
 		all:    list.New(),
 		wt:     newWaitTimeState(),
 		hostID: hostID,
-		config: cfg.withDefaults(),
+		config: cfg.WithDefaults(),
 	}
 }
 
@@ -88,9 +90,15 @@ func (tab *TopicTable) Nodes(topic TopicID) []*enode.Node {
 	return nodes
 }
 
+// Len returns the number of registrations in the table, including expired ones
+// which haven't been removed by Expire yet.
+func (tab *TopicTable) Len() int {
+	return tab.all.Len()
+}
+
 // NextExpiryTime returns the time when the next registration expires.
 func (tab *TopicTable) NextExpiryTime() mclock.AbsTime {
-	e := tab.all.Front()
+	e := tab.all.Back()
 	if e != nil {
 		return e.Value.(*topicTableEntry).exp
 	}
@@ -100,7 +108,7 @@ func (tab *TopicTable) NextExpiryTime() mclock.AbsTime {
 // Expire removes inactive registrations.
 func (tab *TopicTable) Expire() {
 	now := tab.config.Clock.Now()
-	for e := tab.all.Front(); e != nil; e = e.Next() {
+	for e := tab.all.Back(); e != nil; e = tab.all.Back() {
 		reg := e.Value.(*topicTableEntry)
 		if reg.exp > now {
 			break
@@ -116,7 +124,7 @@ func (tab *TopicTable) nextTopicExpiryTime(t TopicID) mclock.AbsTime {
 	if list == nil {
 		return 0
 	}
-	e := list.Front()
+	e := list.Back()
 	if e == nil {
 		return 0 // cannot happen
 	}
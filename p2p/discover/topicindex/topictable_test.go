@@ -19,7 +19,9 @@ package topicindex
 import (
 	mrand "math/rand"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/internal/testlog"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -59,10 +61,96 @@ func TestTopicTableRegisterTwice(t *testing.T) {
 	}
 }
 
+// This test checks that registrations are rejected when the table is full,
+// and the node is told to come back when the oldest registration expires.
+func TestTopicTableOverflow(t *testing.T) {
+	clock := new(mclock.Simulated)
+	cfg := testConfig(t)
+	cfg.Clock = clock
+	cfg.AdCacheSize = 3
+	tab := NewTopicTable(enode.ID{}, cfg)
+
+	for i := 0; i < cfg.AdCacheSize; i++ {
+		if !tab.Add(newNode(), topic1) {
+			t.Fatalf("Add %d failed", i)
+		}
+		clock.Run(time.Minute)
+	}
+	if tab.Add(newNode(), topic2) {
+		t.Fatal("Add succeeded on full table")
+	}
+	// The first registration expires AdLifetime after it was added.
+	want := tab.AdLifetime() - time.Duration(cfg.AdCacheSize)*time.Minute
+	if wt := tab.Register(newNode(), topic2, time.Hour); wt != want {
+		t.Fatalf("wrong wait time %v for full table, want %v", wt, want)
+	}
+	if tab.Len() != cfg.AdCacheSize {
+		t.Fatalf("wrong Len %d, want %d", tab.Len(), cfg.AdCacheSize)
+	}
+}
+
+// This test checks that registrations expire in insertion order.
+func TestTopicTableExpiry(t *testing.T) {
+	clock := new(mclock.Simulated)
+	cfg := testConfig(t)
+	cfg.Clock = clock
+	tab := NewTopicTable(enode.ID{}, cfg)
+
+	n1, n2 := newNode(), newNode()
+	tab.Add(n1, topic1)
+	clock.Run(time.Minute)
+	tab.Add(n2, topic1)
+	if next, want := tab.NextExpiryTime(), mclock.AbsTime(0).Add(tab.AdLifetime()); next != want {
+		t.Fatalf("wrong next expiry time %v, want %v", next, want)
+	}
+
+	// Only the first registration is expired.
+	clock.Run(tab.AdLifetime() - time.Minute)
+	tab.Expire()
+	if tab.Len() != 1 {
+		t.Fatalf("wrong Len %d after first expiry, want 1", tab.Len())
+	}
+	if nodes := tab.Nodes(topic1); len(nodes) != 1 || nodes[0] != n2 {
+		t.Fatalf("wrong nodes after first expiry: %v", nodes)
+	}
+	if !tab.Add(newNode(), topic2) {
+		t.Fatal("slot of expired registration not available")
+	}
+
+	clock.Run(time.Minute)
+	tab.Expire()
+	if len(tab.Nodes(topic1)) != 0 {
+		t.Fatal("topic1 registrations not expired")
+	}
+	if tab.Len() != 1 {
+		t.Fatalf("wrong Len %d, want 1", tab.Len())
+	}
+}
+
+// This test checks that Register does not add a node twice for the same topic,
+// but allows registering it for another topic.
+func TestTopicTableRegisterDedup(t *testing.T) {
+	cfg := testConfig(t)
+	tab := NewTopicTable(enode.ID{}, cfg)
+
+	n := newNode()
+	for i := 0; i < 3; i++ {
+		tab.Register(n, topic1, time.Hour)
+	}
+	tab.Register(n, topic2, time.Hour)
+	if tab.Len() != 2 {
+		t.Fatalf("wrong Len %d, want 2", tab.Len())
+	}
+	if nodes := tab.Nodes(topic1); len(nodes) != 1 {
+		t.Fatalf("node registered %d times for topic1", len(nodes))
+	}
+}
+
 func testConfig(t *testing.T) Config {
 	return Config{
-		AdCacheSize: 20,
-		Log:         testlog.Logger(t, log.LvlTrace),
+		AdCacheSize:      20,
+		RegInitialJitter: -1,
+		Log:              testlog.Logger(t, log.LvlTrace),
 	}
 }
 
@@ -17,11 +17,17 @@
 package discover
 
 import (
+	"bytes"
+	"context"
+	mrand "math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover/topicindex"
 	"github.com/ethereum/go-ethereum/p2p/discover/v5wire"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -33,15 +39,20 @@ type topicSystem struct {
 	transport *UDPv5
 	config    topicindex.Config
 
-	mu  sync.Mutex
-	reg map[topicindex.TopicID]*topicReg
+	mu        sync.Mutex
+	reg       map[topicindex.TopicID]*topicReg
+	regEvents map[topicindex.TopicID]*event.Feed
+	search    map[*topicSearch]struct{}
+	closed    bool
 }
 
 func newTopicSystem(transport *UDPv5, config topicindex.Config) *topicSystem {
 	return &topicSystem{
 		transport: transport,
-		config:    config,
+		config:    config.WithDefaults(),
 		reg:       make(map[topicindex.TopicID]*topicReg),
+		regEvents: make(map[topicindex.TopicID]*event.Feed),
+		search:    make(map[*topicSearch]struct{}),
 	}
 }
 
@@ -49,92 +60,525 @@ func (sys *topicSystem) register(topic topicindex.TopicID, opid uint64) {
 	sys.mu.Lock()
 	defer sys.mu.Unlock()
 
-	if _, ok := sys.reg[topic]; ok {
-		return
+	if !sys.closed {
+		sys.acquireReg(topic, opid)
 	}
-	sys.reg[topic] = newTopicReg(sys, topic, opid)
 }
 
-func (sys *topicSystem) stopRegister(topic topicindex.TopicID) {
+// registerContext starts registration of a topic. The reference taken by this call
+// is released when ctx is done.
+func (sys *topicSystem) registerContext(ctx context.Context, topic topicindex.TopicID, opid uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+
+	if sys.closed {
+		return errClosed
+	}
+	reg := sys.acquireReg(topic, opid)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sys.stopRegisterInstance(topic, reg)
+		case <-reg.quit:
+		}
+	}()
+	return nil
+}
+
+// acquireReg adds a reference to the registration of topic, starting it if
+// necessary. It must be called with sys.mu held.
+func (sys *topicSystem) acquireReg(topic topicindex.TopicID, opid uint64) *topicReg {
+	reg := sys.reg[topic]
+	if reg == nil {
+		reg = newTopicReg(sys, topic, opid)
+		sys.reg[topic] = reg
+	}
+	reg.refcount++
+	return reg
+}
+
+// releaseReg drops a reference to reg. When the last reference is gone, reg is
+// removed from sys.reg and returned. The caller must then stop it after releasing
+// sys.mu. It must be called with sys.mu held.
+func (sys *topicSystem) releaseReg(topic topicindex.TopicID, reg *topicReg) *topicReg {
+	reg.refcount--
+	if reg.refcount > 0 {
+		return nil
+	}
+	delete(sys.reg, topic)
+	return reg
+}
+
+// subscribeRegEvents subscribes to registration events of a topic. The subscription
+// remains valid when registration of the topic is stopped and started again.
+//
+// Events are forwarded to ch by a separate goroutine, so the registration loop is
+// never blocked by a slow subscriber. Events which don't fit into ch are dropped.
+func (sys *topicSystem) subscribeRegEvents(topic topicindex.TopicID, ch chan<- topicindex.RegEvent) event.Subscription {
+	in := make(chan topicindex.RegEvent, 16)
+	sys.mu.Lock()
+	sub := sys.regEventFeed(topic).Subscribe(in)
+	sys.mu.Unlock()
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case ev := <-in:
+				select {
+				case ch <- ev:
+				default:
+					sys.config.Log.Debug("Dropped topic registration event", "topic", topic, "type", ev.Type)
+				}
+			case <-quit:
+				return nil
+			}
+		}
+	})
+}
+
+// regEventFeed returns the event feed of a topic. It must be called with sys.mu held.
+func (sys *topicSystem) regEventFeed(topic topicindex.TopicID) *event.Feed {
+	feed := sys.regEvents[topic]
+	if feed == nil {
+		feed = new(event.Feed)
+		sys.regEvents[topic] = feed
+	}
+	return feed
+}
+
+// registerAll starts registration for multiple topics. A reference is taken for
+// every topic, including those that were already being registered, and the
+// topics are returned so the references can be released by stopRegisterAll.
+func (sys *topicSystem) registerAll(topics []topicindex.TopicID, opid uint64) []topicindex.TopicID {
 	sys.mu.Lock()
 	defer sys.mu.Unlock()
 
+	if sys.closed {
+		return nil
+	}
+	acquired := make([]topicindex.TopicID, 0, len(topics))
+	seen := make(map[topicindex.TopicID]bool, len(topics))
+	for _, topic := range topics {
+		if seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		sys.acquireReg(topic, opid)
+		acquired = append(acquired, topic)
+	}
+	return acquired
+}
+
+// stopRegister releases a reference to the registration of topic.
+// Registration stops when all references are released.
+func (sys *topicSystem) stopRegister(topic topicindex.TopicID) {
+	sys.mu.Lock()
+	var stopped *topicReg
 	if reg := sys.reg[topic]; reg != nil {
-		reg.stop()
-		delete(sys.reg, topic)
+		stopped = sys.releaseReg(topic, reg)
+	}
+	sys.mu.Unlock()
+
+	if stopped != nil {
+		stopped.stop()
 	}
 }
 
-func (sys *topicSystem) stop() {
+// stopRegisterInstance releases a reference to reg if it is still the active
+// registration of the topic.
+func (sys *topicSystem) stopRegisterInstance(topic topicindex.TopicID, reg *topicReg) {
+	sys.mu.Lock()
+	var stopped *topicReg
+	if sys.reg[topic] == reg {
+		stopped = sys.releaseReg(topic, reg)
+	}
+	sys.mu.Unlock()
+
+	if stopped != nil {
+		stopped.stop()
+	}
+}
+
+// stopRegisterAll releases references to the registrations of multiple topics.
+func (sys *topicSystem) stopRegisterAll(topics []topicindex.TopicID) {
+	sys.mu.Lock()
+	var stopped []*topicReg
+	for _, topic := range topics {
+		if reg := sys.reg[topic]; reg != nil {
+			if r := sys.releaseReg(topic, reg); r != nil {
+				stopped = append(stopped, r)
+			}
+		}
+	}
+	sys.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(stopped))
+	for _, reg := range stopped {
+		go func(reg *topicReg) {
+			defer wg.Done()
+			reg.stop()
+		}(reg)
+	}
+	wg.Wait()
+}
+
+// registeredTopics returns the topics being registered, sorted by ID. Topics whose
+// registration is shutting down are not included.
+func (sys *topicSystem) registeredTopics() []topicindex.TopicID {
 	sys.mu.Lock()
 	defer sys.mu.Unlock()
 
+	topics := make([]topicindex.TopicID, 0, len(sys.reg))
 	for topic, reg := range sys.reg {
-		reg.stop()
+		if reg.isRunning() {
+			topics = append(topics, topic)
+		}
+	}
+	sortTopics(topics)
+	return topics
+}
+
+// searchedTopics returns the topics of all running searches, sorted by ID.
+func (sys *topicSystem) searchedTopics() []topicindex.TopicID {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+
+	seen := make(map[topicindex.TopicID]struct{}, len(sys.search))
+	topics := make([]topicindex.TopicID, 0, len(sys.search))
+	for s := range sys.search {
+		if _, ok := seen[s.topic]; !ok {
+			seen[s.topic] = struct{}{}
+			topics = append(topics, s.topic)
+		}
+	}
+	sortTopics(topics)
+	return topics
+}
+
+func sortTopics(topics []topicindex.TopicID) {
+	sort.Slice(topics, func(i, j int) bool {
+		return bytes.Compare(topics[i][:], topics[j][:]) < 0
+	})
+}
+
+// regStats returns the registration statistics of a topic.
+func (sys *topicSystem) regStats(topic topicindex.TopicID) (st topicindex.RegStats, ok bool) {
+	ok = sys.withRegState(topic, func(state *topicindex.Registration) {
+		st = state.Stats()
+	})
+	return st, ok
+}
+
+// regSnapshot returns the registration table of a topic.
+func (sys *topicSystem) regSnapshot(topic topicindex.TopicID) (snap []topicindex.RegBucketInfo, ok bool) {
+	ok = sys.withRegState(topic, func(state *topicindex.Registration) {
+		snap = state.BucketSnapshot()
+	})
+	return snap, ok
+}
+
+// regExpiry returns the time when the earliest ad of a topic expires. The time is
+// measured on Config.Clock.
+func (sys *topicSystem) regExpiry(topic topicindex.TopicID) (exp mclock.AbsTime, ok bool) {
+	found := sys.withRegState(topic, func(state *topicindex.Registration) {
+		if state.RegisteredLen() > 0 {
+			exp = sys.config.Clock.Now().Add(state.NextRegistrationIn())
+			ok = true
+		}
+	})
+	return exp, found && ok
+}
+
+// waitRegistered blocks until at least minCount ads of a topic are registered, or
+// until ctx is done. The topic does not need to be registered when this is called.
+func (sys *topicSystem) waitRegistered(ctx context.Context, topic topicindex.TopicID, minCount int) error {
+	// Events only serve as wakeups here. The subscription drops events while
+	// the channel is full, so one slot is enough.
+	events := make(chan topicindex.RegEvent, 1)
+	sub := sys.subscribeRegEvents(topic, events)
+	defer sub.Unsubscribe()
+
+	for {
+		var registered int
+		sys.withRegState(topic, func(state *topicindex.Registration) {
+			registered = state.RegisteredLen()
+		})
+		if registered >= minCount {
+			return nil
+		}
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// withRegState runs fn on the registration loop of a topic. It returns false if
+// the topic is not being registered.
+func (sys *topicSystem) withRegState(topic topicindex.TopicID, fn func(*topicindex.Registration)) bool {
+	sys.mu.Lock()
+	reg := sys.reg[topic]
+	sys.mu.Unlock()
+
+	if reg == nil {
+		return false
+	}
+	done := make(chan struct{})
+	select {
+	case reg.stateFnCh <- func(state *topicindex.Registration) { fn(state); close(done) }:
+		<-done
+		return true
+	case <-reg.quit:
+		return false
+	}
+}
+
+// blacklistRegistrar removes a registrar node from the registration of a topic.
+func (sys *topicSystem) blacklistRegistrar(topic topicindex.TopicID, id enode.ID) {
+	sys.mu.Lock()
+	reg := sys.reg[topic]
+	sys.mu.Unlock()
+
+	if reg == nil {
+		return
+	}
+	select {
+	case reg.removeCh <- id:
+	case <-reg.quit:
+	}
+}
+
+// stop terminates all registrations and searches. It returns when all their
+// goroutines have exited.
+func (sys *topicSystem) stop() {
+	// Collect everything that's running. The lock is not held while stopping
+	// because searches remove themselves from sys.search when stopped.
+	sys.mu.Lock()
+	sys.closed = true
+	regs := make([]*topicReg, 0, len(sys.reg))
+	for _, reg := range sys.reg {
+		regs = append(regs, reg)
+	}
+	searches := make([]*topicSearch, 0, len(sys.search))
+	for s := range sys.search {
+		searches = append(searches, s)
+	}
+	sys.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(regs) + len(searches))
+	for _, reg := range regs {
+		go func(reg *topicReg) {
+			defer wg.Done()
+			reg.stop()
+		}(reg)
+	}
+	for _, s := range searches {
+		go func(s *topicSearch) {
+			defer wg.Done()
+			s.stop()
+		}(s)
+	}
+	wg.Wait()
+
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	for topic := range sys.reg {
 		delete(sys.reg, topic)
 	}
+	for s := range sys.search {
+		delete(sys.search, s)
+	}
+}
+
+// waitRateLimit blocks until the rate limiter allows another request.
+func (sys *topicSystem) waitRateLimit(ctx context.Context) error {
+	if sys.config.TopicRateLimit == nil {
+		return nil
+	}
+	return sys.config.TopicRateLimit.Wait(ctx)
+}
+
+// quitContext returns a context which is canceled when quit is closed.
+// The returned cancel function must be called to release resources.
+func quitContext(quit <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
 
 func (sys *topicSystem) newSearchIterator(topic topicindex.TopicID, opid uint64) enode.Iterator {
 	sys.mu.Lock()
 	defer sys.mu.Unlock()
 
-	resultCh := make(chan *enode.Node, 200)
+	if sys.closed {
+		return enode.IterNodes(nil)
+	}
+	resultCh := make(chan *enode.Node, sys.config.SearchIteratorBufferSize)
 	s := newTopicSearch(sys, topic, resultCh, opid)
+	sys.search[s] = struct{}{}
 	return newTopicSearchIterator(sys, s, resultCh)
 }
 
+// newSearchIteratorContext is like newSearchIterator, but the search is also stopped
+// when ctx is done.
+func (sys *topicSystem) newSearchIteratorContext(ctx context.Context, topic topicindex.TopicID, opid uint64) enode.Iterator {
+	if ctx.Err() != nil {
+		return enode.IterNodes(nil)
+	}
+	it, ok := sys.newSearchIterator(topic, opid).(*topicSearchIterator)
+	if !ok {
+		return enode.IterNodes(nil)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			it.Close()
+		case <-it.search.quit:
+		}
+	}()
+	return it
+}
+
+func (sys *topicSystem) stopSearch(s *topicSearch) {
+	s.stop()
+
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	delete(sys.search, s)
+}
+
 // topicReg handles registering for a single topic.
 type topicReg struct {
-	state *topicindex.Registration
-	clock mclock.Clock
-	opid  uint64
-
-	wg   sync.WaitGroup
-	quit chan struct{}
+	state   *topicindex.Registration
+	clock   mclock.Clock
+	opid    uint64
+	metrics *topicindex.Metrics
+	db      *enode.DB
+	self    enode.ID
+	log     log.Logger
+	events  *event.Feed
+
+	// refcount is the number of active register calls for the topic.
+	// It is guarded by topicSystem.mu.
+	refcount int
+
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	stopOnce sync.Once
+	running  int32 // 1 while the main loop is running, accessed atomically
 
 	regRequest  chan *topicindex.RegAttempt
 	regResponse chan topicRegResult
+	stateFnCh   chan func(*topicindex.Registration)
+	removeCh    chan enode.ID
 
 	// nodes subscription
 	newNodesCh  chan *enode.Node
 	newNodesSub event.Subscription
 }
 
+// newTopicReg creates a topic registration. It must be called with sys.mu held.
 func newTopicReg(sys *topicSystem, topic topicindex.TopicID, opid uint64) *topicReg {
 	reg := &topicReg{
+		events:      sys.regEventFeed(topic),
 		state:       topicindex.NewRegistration(topic, sys.config),
 		clock:       sys.config.Clock,
 		opid:        opid,
+		metrics:     sys.config.Metrics,
+		db:          sys.transport.db,
+		self:        sys.config.Self,
+		log:         sys.config.Log,
 		quit:        make(chan struct{}),
 		regRequest:  make(chan *topicindex.RegAttempt),
 		regResponse: make(chan topicRegResult),
+		stateFnCh:   make(chan func(*topicindex.Registration)),
+		removeCh:    make(chan enode.ID),
 	}
+	reg.loadState()
 
 	// Set up the subscription for new main table nodes.
 	reg.newNodesCh = make(chan *enode.Node, 100)
 	reg.newNodesSub = sys.transport.tab.subscribeNodes(reg.newNodesCh)
 
+	if reg.metrics != nil {
+		reg.metrics.RegActive.Inc(1)
+	}
+
+	reg.running = 1
 	reg.wg.Add(2)
 	go reg.run(sys)
 	go reg.runRequests(sys)
 	return reg
 }
 
+// isRunning reports whether the registration is running. It returns false as soon
+// as stopping begins. It is safe to call from any goroutine.
+func (reg *topicReg) isRunning() bool {
+	return atomic.LoadInt32(&reg.running) == 1
+}
+
+// stop terminates the registration. It is safe to call more than once.
 func (reg *topicReg) stop() {
-	close(reg.quit)
-	reg.wg.Wait()
+	reg.stopOnce.Do(func() {
+		atomic.StoreInt32(&reg.running, 0)
+		close(reg.quit)
+		reg.wg.Wait()
+		reg.saveState()
+		reg.state.Clear()
+		if reg.metrics != nil {
+			reg.metrics.RegActive.Dec(1)
+		}
+	})
+}
+
+// loadState restores the registration state from the node database.
+func (reg *topicReg) loadState() {
+	topic := reg.state.Topic()
+	data := reg.db.TopicRegState(reg.self, topic)
+	if data == nil {
+		return
+	}
+	if err := reg.state.UnmarshalBinary(data); err != nil {
+		reg.log.Debug("Can't load topic registration state", "topic", topic, "err", err)
+	}
+}
+
+// saveState writes the registration state to the node database.
+func (reg *topicReg) saveState() {
+	topic := reg.state.Topic()
+	data, err := reg.state.MarshalBinary()
+	if err == nil {
+		err = reg.db.StoreTopicRegState(reg.self, topic, data)
+	}
+	if err != nil {
+		reg.log.Debug("Can't store topic registration state", "topic", topic, "err", err)
+	}
 }
 
 func (reg *topicReg) run(sys *topicSystem) {
 	defer reg.wg.Done()
+	defer atomic.StoreInt32(&reg.running, 0)
 	defer reg.newNodesSub.Unsubscribe()
 	defer close(reg.regRequest)
 
 	time := mclock.AbsTime(-1)
 	for {
 		if time >= 0 {
-			if exit := reg.pause(time); exit {
+			if exit := reg.pause(time, lookupInterval(&sys.config)); exit {
 				return
 			}
 		}
@@ -154,14 +598,73 @@ func (reg *topicReg) run(sys *topicSystem) {
 	}
 }
 
-const regloopMinTime = 2 * time.Second
+// lookupInterval returns the minimum duration of a registration loop iteration, which
+// is RegLookupInterval with random jitter applied. The jitter keeps registrations of
+// different topics from refreshing their tables at the same time.
+func lookupInterval(cfg *topicindex.Config) time.Duration {
+	return withJitter(cfg.RegLookupInterval, cfg.RegLookupIntervalJitter)
+}
+
+// refillSchedule computes the delay until the next refill of the registration table
+// from the local node table. Refills are more frequent while the table is sparse or
+// has few registrations. While the table is saturated, the delay grows exponentially.
+type refillSchedule struct {
+	cfg       *topicindex.Config
+	saturated time.Duration // last delay used while the table was saturated
+}
+
+func newRefillSchedule(cfg *topicindex.Config) *refillSchedule {
+	return &refillSchedule{cfg: cfg, saturated: cfg.RegLookupInterval}
+}
+
+// next returns the delay until the next refill. Every call made while the table is
+// saturated doubles the delay, up to RegLookupMaxInterval.
+func (rs *refillSchedule) next(state *topicindex.Registration) time.Duration {
+	d := rs.cfg.RegLookupInterval
+	switch {
+	case state.IsSparse() || state.RegisteredLen() < rs.cfg.RegMinRegistrations:
+		d = rs.cfg.RegFastLookupInterval
+	case state.IsSaturated():
+		rs.saturated *= 2
+		if rs.saturated > rs.cfg.RegLookupMaxInterval {
+			rs.saturated = rs.cfg.RegLookupMaxInterval
+		}
+		d = rs.saturated
+	}
+	return withJitter(d, rs.cfg.RegLookupIntervalJitter)
+}
+
+// reset drops the accumulated backoff. It is called when a registration expires.
+func (rs *refillSchedule) reset() {
+	rs.saturated = rs.cfg.RegLookupInterval
+}
+
+// scheduleAlarm schedules a to fire at time next and returns its channel. When next
+// is Never, the alarm is stopped instead, so an earlier deadline can't fire, and the
+// returned channel is nil.
+func scheduleAlarm(a *mclock.Alarm, next mclock.AbsTime) <-chan struct{} {
+	if topicindex.IsNever(next) {
+		a.Stop()
+		return nil
+	}
+	a.Schedule(next)
+	return a.C()
+}
+
+// withJitter randomizes d by up to j in either direction.
+func withJitter(d, j time.Duration) time.Duration {
+	if j > 0 {
+		d += time.Duration(mrand.Int63n(2*int64(j)+1)) - j
+	}
+	return d
+}
 
-// pause ensures that top-level registration loop iterations take at least regLoopMinTime.
+// pause ensures that top-level registration loop iterations take at least minTime.
 // This prevents the loop from running too hot when the local node table is very empty.
-func (reg *topicReg) pause(lastTime mclock.AbsTime) bool {
+func (reg *topicReg) pause(lastTime mclock.AbsTime, minTime time.Duration) bool {
 	d := reg.clock.Now().Sub(lastTime)
-	if d < regloopMinTime {
-		sleep := reg.clock.NewTimer(regloopMinTime - d)
+	if d < minTime {
+		sleep := reg.clock.NewTimer(minTime - d)
 		defer sleep.Stop()
 		for {
 			select {
@@ -169,6 +672,10 @@ func (reg *topicReg) pause(lastTime mclock.AbsTime) bool {
 				return false
 			case <-reg.newNodesCh:
 				// Need to read this channel to avoid blocking in Table.
+			case fn := <-reg.stateFnCh:
+				fn(reg.state)
+			case id := <-reg.removeCh:
+				reg.state.RemoveNode(id)
 			case <-reg.quit:
 				return true
 			}
@@ -179,10 +686,17 @@ func (reg *topicReg) pause(lastTime mclock.AbsTime) bool {
 
 func (reg *topicReg) runRegistration(sys *topicSystem) (exit bool) {
 	var (
-		updateEv      = mclock.NewAlarm(reg.clock)
-		sendAttempt   *topicindex.RegAttempt
-		sendAttemptCh chan<- *topicindex.RegAttempt
+		updateEv   = mclock.NewAlarm(reg.clock)
+		refillEv   = mclock.NewAlarm(reg.clock)
+		refills    = newRefillSchedule(&sys.config)
+		nextRefill = reg.clock.Now().Add(refills.next(reg.state))
+
+		// pending holds attempts whose request has been started, but not yet
+		// handed to runRequests.
+		pending = make([]*topicindex.RegAttempt, 0, sys.config.RegRequestQueueSize)
 	)
+	defer updateEv.Stop()
+	defer refillEv.Stop()
 
 	for {
 		if reg.state.NodeCount() == 0 {
@@ -190,14 +704,21 @@ func (reg *topicReg) runRegistration(sys *topicSystem) (exit bool) {
 			return false
 		}
 
-		// Disable updates while dispatching the next attempt's request.
+		// Periodically add nodes from the local table. This brings back nodes which
+		// were dropped from the registration table but are still known.
+		refillEv.Schedule(nextRefill)
+
+		// Disable updates while the request queue is full.
 		var updateCh <-chan struct{}
-		if sendAttempt == nil {
-			next := reg.state.NextUpdateTime()
-			if next != topicindex.Never {
-				updateEv.Schedule(next)
-				updateCh = updateEv.C()
-			}
+		if len(pending) < cap(pending) {
+			updateCh = scheduleAlarm(updateEv, reg.state.NextUpdateTime())
+		}
+		var (
+			sendAttempt   *topicindex.RegAttempt
+			sendAttemptCh chan<- *topicindex.RegAttempt
+		)
+		if len(pending) > 0 {
+			sendAttempt, sendAttemptCh = pending[0], reg.regRequest
 		}
 
 		select {
@@ -208,40 +729,103 @@ func (reg *topicReg) runRegistration(sys *topicSystem) (exit bool) {
 		case n := <-reg.newNodesCh:
 			reg.state.AddNodes(nil, []*enode.Node{n})
 
-		// Attempt queue updates.
+		case <-refillEv.C():
+			reg.state.AddNodes(nil, sys.transport.tab.Nodes())
+			nextRefill = reg.clock.Now().Add(refills.next(reg.state))
+
+		case fn := <-reg.stateFnCh:
+			fn(reg.state)
+
+		case id := <-reg.removeCh:
+			reg.state.RemoveNode(id)
+			for i, att := range pending {
+				if att.Node.ID() == id {
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+
+		// Attempt queue updates. All attempts which are due are started
+		// until the queue is full.
 		case <-updateCh:
-			att := reg.state.Update()
-			if att != nil {
-				sendAttempt = att
-				sendAttemptCh = reg.regRequest
+			registered := reg.state.RegisteredLen()
+			for len(pending) < cap(pending) {
+				att := reg.state.Update()
+				if att == nil {
+					break
+				}
+				reg.state.StartRequest(att)
+				pending = append(pending, att)
+			}
+			// Update only removes registrations when they expire.
+			// Refill sooner to replace them.
+			if reg.state.RegisteredLen() < registered {
+				refills.reset()
+				if next := reg.clock.Now().Add(refills.next(reg.state)); next < nextRefill {
+					nextRefill = next
+				}
 			}
 
 		// Registration requests.
 		case sendAttemptCh <- sendAttempt:
-			reg.state.StartRequest(sendAttempt)
-			sendAttempt, sendAttemptCh = nil, nil
+			copy(pending, pending[1:])
+			pending = pending[:len(pending)-1]
 
 		case resp := <-reg.regResponse:
 			if len(resp.nodes) > 0 {
 				reg.state.AddNodes(resp.att.Node, resp.nodes)
 			}
 			if resp.err != nil {
+				if reg.metrics != nil {
+					reg.metrics.RegFailed.Inc(1)
+				}
 				reg.state.HandleErrorResponse(resp.att, resp.err)
+				reg.sendEvent(topicindex.RegEventError, resp.att, resp.err)
 				continue
 			}
-			// TODO: handle overflow
-			wt := time.Duration(resp.msg.WaitTime) * time.Millisecond
 			if len(resp.msg.Ticket) > 0 {
+				// Wait times above the limit are clamped to just above it. This
+				// avoids overflow, and the attempt is still dropped for
+				// exceeding RegMaxWaitTime.
+				wt := msDuration(resp.msg.WaitTime, sys.config.RegMaxWaitTime+time.Millisecond)
 				reg.state.HandleTicketResponse(resp.att, resp.msg.Ticket, wt)
+				reg.sendEvent(topicindex.RegEventTicket, resp.att, nil)
 			} else {
 				// No ticket - registration successful.
-				// WaitTime field means ad lifetime.
-				reg.state.HandleRegistered(resp.att, wt)
+				// WaitTime field means ad lifetime. If the registrar
+				// didn't provide it, the default TTL is used.
+				if reg.metrics != nil {
+					reg.metrics.RegSucceeded.Inc(1)
+				}
+				lifetime := msDuration(resp.msg.WaitTime, sys.config.AdLifetime)
+				reg.state.HandleRegistered(resp.att, lifetime)
+				reg.sendEvent(topicindex.RegEventSuccess, resp.att, nil)
 			}
 		}
 	}
 }
 
+// sendEvent emits a registration event. The event contains a copy of the attempt,
+// so subscribers can read it while the registration continues.
+func (reg *topicReg) sendEvent(typ topicindex.RegEventType, att *topicindex.RegAttempt, err error) {
+	cpy := *att
+	reg.events.Send(topicindex.RegEvent{
+		Type:    typ,
+		Topic:   reg.state.Topic(),
+		Attempt: &cpy,
+		Err:     err,
+	})
+}
+
+// msDuration converts a millisecond count received from the network to a duration.
+// The result is clamped to max.
+func msDuration(ms uint, max time.Duration) time.Duration {
+	if uint64(ms) > uint64(max/time.Millisecond) {
+		return max
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type topicRegResult struct {
 	msg   *v5wire.Regconfirmation
 	nodes []*enode.Node
@@ -250,24 +834,52 @@ type topicRegResult struct {
 	att *topicindex.RegAttempt
 }
 
-// runRequests performs topic registration requests.
-// TODO: this is not great because it sends one at a time and waits for a response.
-// registrations could be sent more async.
+// runRequests performs topic registration requests. Up to config.RegConcurrency
+// requests are in flight at any time, so a slow or unresponsive registrar does
+// not hold up requests to other nodes.
 func (reg *topicReg) runRequests(sys *topicSystem) {
 	defer reg.wg.Done()
 
-	for attempt := range reg.regRequest {
-		n := attempt.Node
-		topic := reg.state.Topic()
-		resp := sys.transport.regtopic(n, topic, attempt.Ticket, reg.opid)
-		resp.att = attempt
+	var (
+		wg          sync.WaitGroup
+		slots       = make(chan struct{}, sys.config.RegConcurrency)
+		ctx, cancel = quitContext(reg.quit)
+	)
+	defer cancel()
+	defer wg.Wait()
 
-		// Send response to main loop.
+	for attempt := range reg.regRequest {
+		// Wait for a free slot.
 		select {
-		case reg.regResponse <- resp:
+		case slots <- struct{}{}:
 		case <-reg.quit:
 			return
 		}
+		wg.Add(1)
+		go func(attempt *topicindex.RegAttempt) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			reg.sendRequest(ctx, sys, attempt)
+		}(attempt)
+	}
+}
+
+// sendRequest performs a single registration request and delivers the
+// response to the main loop.
+func (reg *topicReg) sendRequest(ctx context.Context, sys *topicSystem, attempt *topicindex.RegAttempt) {
+	var resp topicRegResult
+	if err := sys.waitRateLimit(ctx); err != nil {
+		resp.err = err
+	} else {
+		topic := reg.state.Topic()
+		resp = sys.transport.regtopic(ctx, attempt.Node, topic, attempt.Ticket, reg.opid)
+	}
+	resp.att = attempt
+
+	// Send response to main loop.
+	select {
+	case reg.regResponse <- resp:
+	case <-reg.quit:
 	}
 }
 
@@ -276,13 +888,17 @@ type topicSearch struct {
 	topic  topicindex.TopicID
 	opid   uint64
 	config topicindex.Config
+	db     *enode.DB
 
-	wg   sync.WaitGroup
-	quit chan struct{}
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	stopOnce sync.Once
 
 	queryCh     chan *enode.Node
 	queryRespCh chan topicQueryResult
+	queryCount  int // number of queries sent to runRequests, but not answered yet
 	resultCh    chan *enode.Node
+	callbackCh  chan *enode.Node // results for Config.SearchResultCallback
 
 	newNodesCh  chan *enode.Node
 	newNodesSub event.Subscription
@@ -292,12 +908,13 @@ func newTopicSearch(sys *topicSystem, topic topicindex.TopicID, out chan *enode.
 	s := &topicSearch{
 		topic:    topic,
 		config:   sys.config,
+		db:       sys.transport.db,
 		opid:     opid,
 		quit:     make(chan struct{}),
 		resultCh: out,
 
 		// query
-		queryCh:     make(chan *enode.Node),
+		queryCh:     make(chan *enode.Node, sys.config.SearchQueryBatchSize),
 		queryRespCh: make(chan topicQueryResult),
 	}
 
@@ -305,15 +922,53 @@ func newTopicSearch(sys *topicSystem, topic topicindex.TopicID, out chan *enode.
 	s.newNodesCh = make(chan *enode.Node, 100)
 	s.newNodesSub = sys.transport.tab.subscribeNodes(s.newNodesCh)
 
+	if s.config.Metrics != nil {
+		s.config.Metrics.SearchActive.Inc(1)
+	}
+
 	s.wg.Add(2)
 	go s.runLoop(sys)
 	go s.runRequests(sys)
+	if s.config.SearchResultCallback != nil {
+		s.callbackCh = make(chan *enode.Node)
+		s.wg.Add(s.config.CallbackWorkers)
+		for i := 0; i < s.config.CallbackWorkers; i++ {
+			go s.runCallbacks()
+		}
+	}
 	return s
 }
 
+// runCallbacks delivers results to Config.SearchResultCallback.
+func (s *topicSearch) runCallbacks() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case n := <-s.callbackCh:
+			// Don't call back when the search was stopped while the result
+			// was being handed over.
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			s.config.SearchResultCallback(s.topic, n)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// stop terminates the search. It is safe to call more than once.
 func (s *topicSearch) stop() {
-	close(s.quit)
-	s.wg.Wait()
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		s.wg.Wait()
+		if s.config.Metrics != nil {
+			s.config.Metrics.SearchActive.Dec(1)
+		}
+	})
 }
 
 func (s *topicSearch) runLoop(sys *topicSystem) {
@@ -321,7 +976,15 @@ func (s *topicSearch) runLoop(sys *topicSystem) {
 	defer s.newNodesSub.Unsubscribe()
 	defer s.closeDown()
 
-	time := mclock.AbsTime(-1)
+	var (
+		time  = mclock.AbsTime(-1)
+		state *topicindex.Search
+	)
+	defer func() {
+		if state != nil {
+			s.saveAskedSet(state)
+		}
+	}()
 	for {
 		if time >= 0 {
 			if exit := s.pause(time); exit {
@@ -330,7 +993,13 @@ func (s *topicSearch) runLoop(sys *topicSystem) {
 		}
 		time = s.config.Clock.Now()
 
-		state := topicindex.NewSearch(s.topic, s.config)
+		if state == nil {
+			state = topicindex.NewSearch(s.topic, s.config)
+			s.loadAskedSet(state)
+		} else {
+			state = topicindex.NewSearchFromPrior(state, s.config)
+			s.config.Log.Debug("Restarting topic search", "topic", s.topic, "unasked", state.Stats().Unasked)
+		}
 		nodes := sys.transport.tab.Nodes()
 		if len(nodes) == 0 {
 			continue // Local table is empty, retry later.
@@ -344,12 +1013,36 @@ func (s *topicSearch) runLoop(sys *topicSystem) {
 
 }
 
-// pause ensures that top-level loop iterations take at least regLoopMinTime.
-// This prevents the loop from running too hot when the local node table is very empty.
+// loadAskedSet restores the nodes asked by a previous search for the topic, so
+// they aren't queried again.
+func (s *topicSearch) loadAskedSet(state *topicindex.Search) {
+	data := s.db.TopicSearchState(s.config.Self, s.topic)
+	if data == nil {
+		return
+	}
+	if err := state.UnmarshalAskedSet(data); err != nil {
+		s.config.Log.Debug("Can't load topic search state", "topic", s.topic, "err", err)
+	}
+}
+
+// saveAskedSet writes the nodes asked by the search to the node database.
+func (s *topicSearch) saveAskedSet(state *topicindex.Search) {
+	data, err := state.MarshalAskedSet()
+	if err == nil {
+		err = s.db.StoreTopicSearchState(s.config.Self, s.topic, data)
+	}
+	if err != nil {
+		s.config.Log.Debug("Can't store topic search state", "topic", s.topic, "err", err)
+	}
+}
+
+// pause ensures that top-level loop iterations take at least SearchLookupMinDelay.
+// Every iteration seeds the search from the local node table. The pause prevents
+// the loop from running too hot when the local node table is very empty.
 func (s *topicSearch) pause(lastTime mclock.AbsTime) bool {
 	d := s.config.Clock.Now().Sub(lastTime)
-	if d < regloopMinTime {
-		sleep := s.config.Clock.NewTimer(regloopMinTime - d)
+	if min := s.config.SearchLookupMinDelay; d < min {
+		sleep := s.config.Clock.NewTimer(min - d)
 		defer sleep.Stop()
 		for {
 			select {
@@ -367,12 +1060,13 @@ func (s *topicSearch) pause(lastTime mclock.AbsTime) bool {
 
 func (s *topicSearch) run(state *topicindex.Search) (exit bool) {
 	var (
-		queryCh     chan<- *enode.Node
-		queryTarget *enode.Node
-		resultCh    chan<- *enode.Node
-		result      *enode.Node
-		nresults    int
+		queryAlarm = mclock.NewAlarm(s.config.Clock)
+		resultCh   chan<- *enode.Node
+		result     *enode.Node
+		nresults   int
+		metrics    = s.config.Metrics
 	)
+	defer queryAlarm.Stop()
 
 	for {
 		// State rollover.
@@ -380,18 +1074,24 @@ func (s *topicSearch) run(state *topicindex.Search) (exit bool) {
 			s.config.Log.Debug("Topic search rollover", "topic", s.topic, "nres", nresults)
 			return false
 		}
-		// Ensure there is always one query running.
-		if queryTarget == nil {
-			t := state.QueryTarget()
-			if t != nil {
-				queryCh = s.queryCh
-				queryTarget = t
-			}
+		// The search can't make progress when all nodes have been asked and no
+		// results are pending. Start over instead of waiting forever.
+		if s.queryCount == 0 && state.PeekResult() == nil && topicindex.IsNever(state.NextQueryTime()) {
+			s.config.Log.Debug("Topic search exhausted", "topic", s.topic, "nres", nresults)
+			return false
+		}
+		// Schedule the next query when the current batch isn't full.
+		var queryEv <-chan struct{}
+		if s.queryCount < s.config.SearchQueryBatchSize {
+			queryEv = scheduleAlarm(queryAlarm, state.NextQueryTime())
 		}
 		// Dispatch result when available.
 		if n := state.PeekResult(); n != nil {
 			result = n
 			resultCh = s.resultCh
+			if s.callbackCh != nil {
+				resultCh = s.callbackCh
+			}
 		}
 
 		select {
@@ -399,18 +1099,27 @@ func (s *topicSearch) run(state *topicindex.Search) (exit bool) {
 		case <-s.quit:
 			return true
 
+		// New nodes from the local table can be queried right away, without
+		// waiting for the next rollover.
+		case n := <-s.newNodesCh:
+			state.AddTableNodes([]*enode.Node{n})
+
 		// Queries.
-		case queryCh <- queryTarget:
+		case <-queryEv:
+			s.startQueries(state)
 		case resp := <-s.queryRespCh:
+			s.queryCount--
 			state.AddNodes(resp.src, resp.auxNodes)
 			state.AddQueryResults(resp.src, resp.topicNodes)
 			if resp.err != nil {
 				s.config.Log.Debug("TOPICQUERY/v5 failed", "topic", s.topic, "id", resp.src.ID(), "err", resp.err)
 			}
-			queryTarget, queryCh = nil, nil
 
 		// Results.
 		case resultCh <- result:
+			if metrics != nil {
+				metrics.SearchResults.Inc(1)
+			}
 			nresults++
 			state.PopResult()
 			result, resultCh = nil, nil
@@ -418,6 +1127,22 @@ func (s *topicSearch) run(state *topicindex.Search) (exit bool) {
 	}
 }
 
+// startQueries hands query targets to runRequests until the batch is full or the
+// search state doesn't allow more queries right now.
+func (s *topicSearch) startQueries(state *topicindex.Search) {
+	for s.queryCount < s.config.SearchQueryBatchSize {
+		next := state.NextQueryTime()
+		if topicindex.IsNever(next) || next > s.config.Clock.Now() {
+			return
+		}
+		// This can't block: queryCh has room for a full batch, and queryCount
+		// includes all queries which are still in the channel.
+		s.queryCh <- state.QueryTarget()
+		state.StartQuery()
+		s.queryCount++
+	}
+}
+
 func (s *topicSearch) closeDown() {
 	close(s.queryCh)
 	// Drain result channel. This guarantees that, when the iterator's
@@ -435,22 +1160,160 @@ type topicQueryResult struct {
 	err        error
 }
 
+// runRequests performs topic queries. Queries which are available at the same time
+// are taken as a batch of up to config.SearchQueryBatchSize and sent concurrently.
+// The responses are delivered to the main loop when the whole batch is done.
 func (s *topicSearch) runRequests(sys *topicSystem) {
 	defer s.wg.Done()
 
+	ctx, cancel := quitContext(s.quit)
+	defer cancel()
+
+	var (
+		batch   = make([]*enode.Node, 0, s.config.SearchQueryBatchSize)
+		results = make([]topicQueryResult, s.config.SearchQueryBatchSize)
+	)
 	for n := range s.queryCh {
-		result := sys.transport.topicQuery(n, s.topic, s.opid)
-		result.src = n
+		batch = append(batch[:0], n)
+		batch = s.dequeueBatch(batch)
+
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for i, n := range batch {
+			go func(i int, n *enode.Node) {
+				defer wg.Done()
+				results[i] = s.query(ctx, sys, n)
+			}(i, n)
+		}
+		wg.Wait()
 
-		// Send response to main loop.
+		// Send responses to main loop.
+		for _, result := range results[:len(batch)] {
+			select {
+			case s.queryRespCh <- result:
+			case <-s.quit:
+				return
+			}
+		}
+	}
+}
+
+// dequeueBatch adds queries which are already waiting in queryCh to batch, until
+// the batch is full.
+func (s *topicSearch) dequeueBatch(batch []*enode.Node) []*enode.Node {
+	for len(batch) < cap(batch) {
 		select {
-		case s.queryRespCh <- result:
-		case <-s.quit:
+		case n, ok := <-s.queryCh:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, n)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// query performs a single topic query. With SearchWarmUpFindnode, the node's
+// record is requested first, so both sides have completed a handshake before the
+// query is sent.
+func (s *topicSearch) query(ctx context.Context, sys *topicSystem, n *enode.Node) topicQueryResult {
+	if s.config.SearchWarmUpFindnode {
+		// The query is skipped when the node doesn't answer FINDNODE.
+		if err := s.warmUp(ctx, sys, n); err != nil {
+			return topicQueryResult{src: n, err: err}
+		}
+	}
+	var result topicQueryResult
+	if err := sys.waitRateLimit(ctx); err != nil {
+		result.err = err
+	} else {
+		qctx, qcancel := context.WithTimeout(ctx, s.config.SearchQueryTimeout)
+		start := s.config.Clock.Now()
+		result = sys.transport.topicQuery(qctx, n, s.topic, s.opid)
+		qcancel()
+		// Latency is recorded for failed queries as well. Time spent waiting
+		// for the rate limiter is not included.
+		if s.config.Metrics != nil {
+			s.config.Metrics.QueryLatency.Update(time.Duration(s.config.Clock.Now() - start))
+		}
+	}
+	result.src = n
+	return result
+}
+
+// warmUp sends FINDNODE for distance zero to n. The request counts towards
+// TopicRateLimit like the query itself.
+func (s *topicSearch) warmUp(ctx context.Context, sys *topicSystem, n *enode.Node) error {
+	if err := sys.waitRateLimit(ctx); err != nil {
+		return err
+	}
+	_, err := sys.transport.findnodeContext(ctx, n, []uint{0}, s.opid)
+	return err
+}
+
+// mergedIterator returns the results of several iterators. Each source runs in its
+// own goroutine and sends results on a shared unbuffered channel. Channel senders are
+// served in order, so sources which have results available take turns.
+type mergedIterator struct {
+	sources []enode.Iterator
+	ch      chan *enode.Node
+	quit    chan struct{}
+	closing sync.Once
+	cur     *enode.Node
+}
+
+func newMergedIterator(sources []enode.Iterator) *mergedIterator {
+	m := &mergedIterator{
+		sources: sources,
+		ch:      make(chan *enode.Node),
+		quit:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+	for _, it := range sources {
+		go m.runSource(it, &wg)
+	}
+	// Next returns false when all sources have ended.
+	go func() {
+		wg.Wait()
+		close(m.ch)
+	}()
+	return m
+}
+
+func (m *mergedIterator) runSource(it enode.Iterator, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for it.Next() {
+		select {
+		case m.ch <- it.Node():
+		case <-m.quit:
 			return
 		}
 	}
 }
 
+func (m *mergedIterator) Next() bool {
+	n, ok := <-m.ch
+	m.cur = n
+	return ok
+}
+
+func (m *mergedIterator) Node() *enode.Node {
+	return m.cur
+}
+
+// Close closes all sources.
+func (m *mergedIterator) Close() {
+	m.closing.Do(func() {
+		close(m.quit)
+		for _, it := range m.sources {
+			it.Close()
+		}
+	})
+}
+
 // topicSearchIterator implements enode.Iterator. It is an iterator
 // that returns nodes found by topic search.
 type topicSearchIterator struct {
@@ -459,6 +1322,8 @@ type topicSearchIterator struct {
 	ch      <-chan *enode.Node
 	closing sync.Once
 	cur     *enode.Node
+	next    *enode.Node // result taken from ch by Peek
+	peeked  bool
 }
 
 func newTopicSearchIterator(sys *topicSystem, search *topicSearch, ch <-chan *enode.Node) *topicSearchIterator {
@@ -466,15 +1331,99 @@ func newTopicSearchIterator(sys *topicSystem, search *topicSearch, ch <-chan *en
 }
 
 func (tsi *topicSearchIterator) Next() bool {
+	if tsi.peeked {
+		tsi.cur, tsi.next, tsi.peeked = tsi.next, nil, false
+		return true
+	}
 	n, ok := <-tsi.ch
 	tsi.cur = n
 	return ok
 }
 
+// Peek returns the result that the next call to Next will move to, or nil if no
+// result is buffered. It does not block and does not change the value of Node.
+// A peeked result is not delivered to iterators created by WithContext.
+func (tsi *topicSearchIterator) Peek() *enode.Node {
+	if !tsi.peeked {
+		select {
+		case n, ok := <-tsi.ch:
+			if !ok {
+				return nil
+			}
+			tsi.next, tsi.peeked = n, true
+		default:
+			return nil
+		}
+	}
+	return tsi.next
+}
+
 func (tsi *topicSearchIterator) Node() *enode.Node {
 	return tsi.cur
 }
 
 func (tsi *topicSearchIterator) Close() {
-	tsi.closing.Do(tsi.search.stop)
+	tsi.closing.Do(func() { tsi.sys.stopSearch(tsi.search) })
+}
+
+// Done returns a channel which is closed when the search stops, either because the
+// iterator was closed or because the topic system was shut down.
+func (tsi *topicSearchIterator) Done() <-chan struct{} {
+	return tsi.search.quit
+}
+
+// WithFilter returns an iterator which skips results for which fn returns false.
+// The filter runs in the goroutine calling Next. Closing the returned iterator
+// also closes tsi.
+func (tsi *topicSearchIterator) WithFilter(fn func(*enode.Node) bool) enode.Iterator {
+	return enode.Filter(tsi, fn)
+}
+
+// WithContext returns an iterator which ends when ctx is done. Canceling ctx or closing
+// the returned iterator does not stop the search, so the underlying iterator must still
+// be closed by its owner.
+func (tsi *topicSearchIterator) WithContext(ctx context.Context) enode.Iterator {
+	return &topicSearchCtxIterator{
+		ch:     tsi.ch,
+		ctx:    ctx,
+		closed: make(chan struct{}),
+	}
+}
+
+// topicSearchCtxIterator reads results of a topic search until its context is done.
+type topicSearchCtxIterator struct {
+	ch      <-chan *enode.Node
+	ctx     context.Context
+	closed  chan struct{}
+	closing sync.Once
+	cur     *enode.Node
+}
+
+func (it *topicSearchCtxIterator) Next() bool {
+	it.cur = nil
+	select {
+	case <-it.closed:
+		return false
+	default:
+	}
+	if it.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case n, ok := <-it.ch:
+		it.cur = n
+		return ok
+	case <-it.ctx.Done():
+		return false
+	case <-it.closed:
+		return false
+	}
+}
+
+func (it *topicSearchCtxIterator) Node() *enode.Node {
+	return it.cur
+}
+
+func (it *topicSearchCtxIterator) Close() {
+	it.closing.Do(func() { close(it.closed) })
 }
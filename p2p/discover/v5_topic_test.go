@@ -17,13 +17,25 @@
 package discover
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p/discover/topicindex"
 	"github.com/ethereum/go-ethereum/p2p/discover/v5wire"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -49,6 +61,8 @@ func TestTopicReg(t *testing.T) {
 func TestTopicRegNodeTableUpdates(t *testing.T) {
 	cfg := Config{
 		PingInterval: 1 * time.Second,
+		// Disable table refills, node2 must arrive through the table subscription.
+		Topic: topicindex.Config{RegFastLookupInterval: time.Hour, RegLookupInterval: time.Hour},
 	}
 	test := newUDPV5Test(t, cfg)
 	defer test.close()
@@ -115,6 +129,1193 @@ func TestTopicRegNodeTableUpdates(t *testing.T) {
 	}
 }
 
+// This test checks that registration loop iterations are spaced by
+// RegLookupInterval ± RegLookupIntervalJitter.
+func TestTopicRegLookupInterval(t *testing.T) {
+	var (
+		clock = new(mclock.Simulated)
+		cfg   = topicindex.Config{Clock: clock}.WithDefaults()
+		min   = cfg.RegLookupInterval - cfg.RegLookupIntervalJitter
+		max   = cfg.RegLookupInterval + cfg.RegLookupIntervalJitter
+	)
+	for i := 0; i < 100; i++ {
+		if d := lookupInterval(&cfg); d < min || d > max {
+			t.Fatalf("lookup interval %v out of range [%v, %v]", d, min, max)
+		}
+	}
+
+	reg := &topicReg{clock: clock, quit: make(chan struct{}), newNodesCh: make(chan *enode.Node)}
+	interval := lookupInterval(&cfg)
+	done := make(chan struct{})
+	go func() {
+		reg.pause(clock.Now(), interval)
+		close(done)
+	}()
+	clock.WaitForTimers(1)
+	clock.Run(interval - 1)
+	select {
+	case <-done:
+		t.Fatal("pause returned before interval")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Run(1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pause did not return after interval")
+	}
+}
+
+// This test checks that the refill interval adapts to the state of the
+// registration table.
+func TestTopicRegRefillInterval(t *testing.T) {
+	var (
+		clock = new(mclock.Simulated)
+		cfg   = topicindex.Config{
+			Clock:                   clock,
+			RegBucketSize:           1,
+			RegMinRegistrations:     5,
+			RegInitialJitter:        -1,
+			RegLookupIntervalJitter: -1,
+		}.WithDefaults()
+		state   = topicindex.NewRegistration(testTopic1, cfg)
+		target  = enode.ID(testTopic1)
+		refills = newRefillSchedule(&cfg)
+	)
+	check := func(want time.Duration, context string) {
+		t.Helper()
+		if d := refills.next(state); d != want {
+			t.Fatalf("%s: refill interval %v, want %v", context, d, want)
+		}
+	}
+	check(cfg.RegFastLookupInterval, "empty table")
+
+	// Fill 21 buckets. The table isn't sparse when 20 of them have active attempts.
+	for d := 256; d > 235; d-- {
+		state.AddNodes(nil, []*enode.Node{unwrapNode(nodeAtDistance(target, d, intIP(d)))})
+	}
+	register := func(n int) {
+		for i := 0; i < n; i++ {
+			att := state.Update()
+			state.StartRequest(att)
+			state.HandleRegistered(att, cfg.AdLifetime)
+		}
+	}
+	register(4)
+	check(cfg.RegFastLookupInterval, "few registrations")
+	register(16)
+	check(cfg.RegLookupInterval, "one bucket not registered")
+	register(1)
+
+	// While the table stays saturated, the interval doubles up to the maximum.
+	for d := 2 * cfg.RegLookupInterval; d < cfg.RegLookupMaxInterval; d *= 2 {
+		check(d, "saturated")
+	}
+	check(cfg.RegLookupMaxInterval, "saturated at maximum")
+	check(cfg.RegLookupMaxInterval, "saturated at maximum")
+
+	// When the registrations expire, refills are fast again.
+	clock.Run(cfg.AdLifetime)
+	state.Update()
+	refills.reset()
+	check(cfg.RegFastLookupInterval, "after expiry")
+
+	// The backoff starts over when the table becomes saturated again.
+	for d := 256; d > 235; d-- {
+		state.AddNodes(nil, []*enode.Node{unwrapNode(nodeAtDistance(target, d, intIP(d+100)))})
+	}
+	register(21)
+	check(2*cfg.RegLookupInterval, "saturated after reset")
+}
+
+// This test checks that an unresponsive registrar does not block registration
+// requests to other nodes, and that stopping registration waits for in-flight
+// requests.
+func TestTopicRegConcurrentRequests(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		key2, ln2 = test.createNode(2)
+		keys      = map[enode.ID]*ecdsa.PrivateKey{ln1.ID(): key1, ln2.ID(): key2}
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	test.table.addSeenNode(wrapNode(ln2.Node()))
+	test.udp.RegisterTopic(testTopic1, 1)
+
+	// Both registrars should receive REGTOPIC before the first request times out.
+	var (
+		start    time.Time
+		requests []*v5wire.Regtopic
+		addrs    []*net.UDPAddr
+	)
+	for len(requests) < 2 {
+		test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+			if len(requests) == 0 {
+				start = time.Now()
+			}
+			requests = append(requests, p)
+			addrs = append(addrs, addr)
+		})
+	}
+	if d := time.Since(start); d >= respTimeoutV5 {
+		t.Fatalf("second REGTOPIC sent after %v, should not wait for first response", d)
+	}
+
+	// Answer the second request only. The first one will time out.
+	fast := test.nodesByIP[string(addrs[1].IP)]
+	test.packetInFrom(keys[fast.ID()], addrs[1], &v5wire.Regconfirmation{
+		ReqID:    requests[1].ReqID,
+		WaitTime: 900000,
+	})
+
+	// Stopping must complete once the unanswered request has timed out.
+	done := make(chan struct{})
+	go func() {
+		test.udp.StopRegisterTopic(testTopic1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * respTimeoutV5):
+		t.Fatal("StopRegisterTopic did not return")
+	}
+}
+
+// This test checks that due attempts are started while earlier requests are
+// still waiting for dispatch.
+func TestTopicRegRequestQueue(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{RegConcurrency: 1, RegRequestQueueSize: 4, RegInitialJitter: -1},
+	})
+	defer test.close()
+
+	for i := 1; i <= 3; i++ {
+		_, ln := test.createNode(i)
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+	test.udp.RegisterTopic(testTopic1, 1)
+	defer test.udp.StopRegisterTopic(testTopic1)
+
+	// The first request is not answered. Only one request can be in flight, but
+	// the other attempts should be started before it times out.
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {})
+	deadline := time.Now().Add(respTimeoutV5 / 2)
+	for {
+		snap, _ := test.udp.TopicRegistrationSnapshot(testTopic1)
+		started := 0
+		for _, b := range snap {
+			for _, att := range b.Attempts {
+				started += att.Attempts
+			}
+		}
+		if started == 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 3 attempts started", started)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// This test checks that the registration loop keeps running while the request
+// queue is full and the request workers are stuck.
+func TestTopicRegRequestQueueFull(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{RegConcurrency: 1, RegRequestQueueSize: 1, RegInitialJitter: -1},
+	})
+	defer test.close()
+
+	nodeIDs := make(map[string]enode.ID)
+	for i := 1; i <= 5; i++ {
+		_, ln := test.createNode(i)
+		nodeIDs[string(ln.Node().IP())] = ln.ID()
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+	test.udp.RegisterTopic(testTopic1, 1)
+	defer test.udp.StopRegisterTopic(testTopic1)
+
+	// startedAttempts returns the IDs of attempts which have been started.
+	startedAttempts := func() []enode.ID {
+		snap, ok := test.udp.TopicRegistrationSnapshot(testTopic1)
+		if !ok {
+			t.Fatal("registration not running")
+		}
+		var ids []enode.ID
+		for _, b := range snap {
+			for _, att := range b.Attempts {
+				if att.Attempts > 0 {
+					ids = append(ids, att.NodeID)
+				}
+			}
+		}
+		return ids
+	}
+	waitStarted := func(n int) []enode.ID {
+		deadline := time.Now().Add(respTimeoutV5 / 2)
+		for {
+			ids := startedAttempts()
+			if len(ids) == n {
+				return ids
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d attempts started, want %d", len(ids), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The first request is not answered, so the only request slot stays busy.
+	// One more attempt is held by the request worker and one is queued. After
+	// that, no further attempts are started.
+	var inflight enode.ID
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+		inflight = nodeIDs[string(addr.IP)]
+	})
+	started := waitStarted(3)
+	time.Sleep(50 * time.Millisecond)
+	if ids := startedAttempts(); len(ids) != 3 {
+		t.Fatalf("%d attempts started with full queue, want 3", len(ids))
+	}
+
+	// Removing the waiting registrars frees the queue. The loop should resume
+	// and start the next due attempt while the first request is still pending.
+	for _, id := range started {
+		if id != inflight {
+			test.udp.BlacklistRegistrar(testTopic1, id)
+		}
+	}
+	waitStarted(2)
+}
+
+// This test checks that outgoing topic requests are limited by
+// Config.TopicRateLimit, regardless of the number of topics.
+func TestTopicRateLimit(t *testing.T) {
+	const reqPerSecond = 10
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{TopicRateLimit: rate.NewLimiter(reqPerSecond, 1)},
+	})
+	defer test.close()
+
+	const numNodes = 12
+	for i := 1; i <= numNodes; i++ {
+		_, ln := test.createNode(i)
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+	start := time.Now()
+	cancel := test.udp.RegisterTopics([]topicindex.TopicID{{1}, {2}, {3}})
+
+	// Without the limit, the first request to every node would be sent immediately.
+	// With a burst size of one, the requests are spaced out according to the rate.
+	const count = numNodes
+	for i := 0; i < count; i++ {
+		test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {})
+	}
+	minTime := time.Duration(count-1) * time.Second / reqPerSecond
+	if d := time.Since(start); d < minTime {
+		t.Fatalf("%d requests sent in %v, want at least %v", count, d, minTime)
+	}
+
+	// Stop and discard requests sent in the meantime.
+	cancel()
+	test.pipe.mu.Lock()
+	test.pipe.queue = nil
+	test.pipe.mu.Unlock()
+}
+
+// This test checks RegisterTopics and RegisteredTopics.
+func TestTopicRegisterMultiple(t *testing.T) {
+	test := newUDPV5Test(t, Config{})
+	defer test.close()
+
+	var (
+		t1 = topicindex.TopicID{1}
+		t2 = topicindex.TopicID{2}
+		t3 = topicindex.TopicID{3}
+	)
+	cancel1 := test.udp.RegisterTopics([]topicindex.TopicID{t2, t1, t2})
+	cancel2 := test.udp.RegisterTopics([]topicindex.TopicID{t2, t3})
+	if got, want := test.udp.RegisteredTopics(), []topicindex.TopicID{t1, t2, t3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong registered topics %x, want %x", got, want)
+	}
+
+	// t2 is still referenced by the first call, so it stays registered.
+	cancel2()
+	cancel2()
+	if got, want := test.udp.RegisteredTopics(), []topicindex.TopicID{t1, t2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong registered topics %x after cancel, want %x", got, want)
+	}
+	cancel1()
+	if got := test.udp.RegisteredTopics(); len(got) != 0 {
+		t.Fatalf("topics %x still registered after cancel", got)
+	}
+}
+
+// This test checks that registration of a topic stays active until every
+// RegisterTopic call has been paired with StopRegisterTopic.
+func TestTopicRegisterRefcount(t *testing.T) {
+	test := newUDPV5Test(t, Config{})
+	defer test.close()
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			test.udp.RegisterTopic(testTopic1, 0)
+		}()
+	}
+	wg.Wait()
+
+	wg.Add(n - 1)
+	for i := 0; i < n-1; i++ {
+		go func() {
+			defer wg.Done()
+			test.udp.StopRegisterTopic(testTopic1)
+		}()
+	}
+	wg.Wait()
+	if got := test.udp.RegisteredTopics(); len(got) != 1 {
+		t.Fatalf("registration stopped before last reference was released: %x", got)
+	}
+
+	// RegisterTopics shares the reference count.
+	cancel := test.udp.RegisterTopics([]topicindex.TopicID{testTopic1})
+	test.udp.StopRegisterTopic(testTopic1)
+	if got := test.udp.RegisteredTopics(); len(got) != 1 {
+		t.Fatalf("registration stopped while RegisterTopics holds a reference: %x", got)
+	}
+	cancel()
+	if got := test.udp.RegisteredTopics(); len(got) != 0 {
+		t.Fatalf("topics %x still registered after last release", got)
+	}
+}
+
+// This test checks that scheduleAlarm cancels the pending deadline when the
+// next event is Never.
+func TestScheduleAlarm(t *testing.T) {
+	clock := new(mclock.Simulated)
+	alarm := mclock.NewAlarm(clock)
+	defer alarm.Stop()
+
+	if ch := scheduleAlarm(alarm, clock.Now().Add(time.Second)); ch != alarm.C() {
+		t.Fatal("wrong channel for scheduled alarm")
+	}
+	// When the next event becomes Never, the earlier deadline must not fire.
+	if ch := scheduleAlarm(alarm, topicindex.Never); ch != nil {
+		t.Fatal("non-nil channel for Never")
+	}
+	clock.Run(2 * time.Second)
+	select {
+	case <-alarm.C():
+		t.Fatal("alarm fired after Never was scheduled")
+	default:
+	}
+}
+
+// This test checks that msDuration converts millisecond counts exactly and clamps
+// them to the limit.
+func TestMsDuration(t *testing.T) {
+	const max = 20 * time.Minute
+	check := func(ms uint) bool {
+		d := msDuration(ms, max)
+		if d < 0 || d > max {
+			return false
+		}
+		return uint64(ms) > uint64(max/time.Millisecond) || d == time.Duration(ms)*time.Millisecond
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ms := range []uint{0, ^uint(0) / 1000, ^uint(0) >> 1, ^uint(0)} {
+		if !check(ms) {
+			t.Errorf("wrong duration %v for %d ms", msDuration(ms, max), ms)
+		}
+	}
+}
+
+// This test checks the topic registration and search introspection methods.
+func TestTopicActiveTopics(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		t1 = topicindex.TopicID{1}
+		t2 = topicindex.TopicID{2}
+	)
+	test.udp.RegisterTopic(t2, 0)
+	test.udp.RegisterTopic(t1, 0)
+	if got, want := test.udp.RegisteredTopics(), []topicindex.TopicID{t1, t2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong active registrations %x, want %x", got, want)
+	}
+	if _, ok := test.udp.TopicRegistrationStatus(t1); !ok {
+		t.Fatal("no registration status for registered topic")
+	}
+	test.udp.StopRegisterTopic(t1)
+	if got, want := test.udp.RegisteredTopics(), []topicindex.TopicID{t2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong active registrations %x after stop, want %x", got, want)
+	}
+	if _, ok := test.udp.TopicRegistrationStatus(t1); ok {
+		t.Fatal("registration status returned for stopped topic")
+	}
+	test.udp.StopRegisterTopic(t2)
+
+	it1 := test.udp.TopicSearch(t2, 0)
+	it2 := test.udp.TopicSearch(t2, 0)
+	it3 := test.udp.TopicSearch(t1, 0)
+	if got, want := test.udp.ActiveTopicSearches(), []topicindex.TopicID{t1, t2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong active searches %x, want %x", got, want)
+	}
+	it1.Close()
+	it3.Close()
+	if got, want := test.udp.ActiveTopicSearches(), []topicindex.TopicID{t2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong active searches %x after close, want %x", got, want)
+	}
+	it2.Close()
+	if got := test.udp.ActiveTopicSearches(); len(got) != 0 {
+		t.Fatalf("searches %x still active after close", got)
+	}
+}
+
+func TestTopicRegEvents(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{RegMaxBackoff: 100 * time.Millisecond},
+	})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	events, unsub := test.udp.TopicRegEvents(testTopic1)
+	defer unsub()
+	test.udp.RegisterTopic(testTopic1, 0)
+	defer test.udp.StopRegisterTopic(testTopic1)
+
+	// The first request times out, the second one gets a ticket, and the
+	// third one is accepted.
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {})
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.Regconfirmation{ReqID: p.ReqID, Ticket: []byte{1}, WaitTime: 1})
+	})
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.Regconfirmation{ReqID: p.ReqID, WaitTime: 900000})
+	})
+
+	want := []topicindex.RegEventType{topicindex.RegEventError, topicindex.RegEventTicket, topicindex.RegEventSuccess}
+	for i, typ := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != typ {
+				t.Fatalf("event %d has type %d, want %d", i, ev.Type, typ)
+			}
+			if ev.Topic != testTopic1 || ev.Attempt.Node.ID() != ln1.ID() {
+				t.Fatalf("event %d has wrong topic/node", i)
+			}
+			if (ev.Err != nil) != (typ == topicindex.RegEventError) {
+				t.Fatalf("event %d has wrong error %v", i, ev.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+}
+
+// This test checks that the ad lifetime announced by the registrar is used,
+// and Config.RegDefaultTTL is assumed when it is missing.
+func TestTopicRegLifetime(t *testing.T) {
+	defaultTTL := 5 * time.Minute
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{RegDefaultTTL: defaultTTL},
+	})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		key2, ln2 = test.createNode(2)
+		ttl       = map[enode.ID]time.Duration{ln1.ID(): time.Minute, ln2.ID(): defaultTTL}
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	test.table.addSeenNode(wrapNode(ln2.Node()))
+
+	events, unsub := test.udp.TopicRegEvents(testTopic1)
+	defer unsub()
+	test.udp.RegisterTopic(testTopic1, 0)
+	defer test.udp.StopRegisterTopic(testTopic1)
+
+	// node1 announces a lifetime of one minute, node2 doesn't announce one.
+	for i := 0; i < 2; i++ {
+		test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+			if addr.IP.Equal(ln1.Node().IP()) {
+				test.packetInFrom(key1, addr, &v5wire.Regconfirmation{ReqID: p.ReqID, WaitTime: 60000})
+			} else {
+				test.packetInFrom(key2, addr, &v5wire.Regconfirmation{ReqID: p.ReqID})
+			}
+		})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			want := ttl[ev.Attempt.Node.ID()]
+			if d := time.Duration(ev.Attempt.NextTime - mclock.Now()); d > want || d < want-time.Second {
+				t.Errorf("node %v: ad expires in %v, want %v", ev.Attempt.Node.ID(), d, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+}
+
+// This test checks that a subscriber which stops reading events doesn't block
+// registration, and that the transport can still be closed.
+func TestTopicRegEventsSlowSubscriber(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	_, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	// The subscriber never reads the channel.
+	_, unsub := test.udp.TopicRegEvents(testTopic1)
+	defer unsub()
+	test.udp.RegisterTopic(testTopic1, 0)
+
+	// Send more events than the channel buffer can hold.
+	sys := test.udp.topicSys
+	sys.mu.Lock()
+	reg := sys.reg[testTopic1]
+	sys.mu.Unlock()
+	att := &topicindex.RegAttempt{Node: ln1.Node()}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		sys.withRegState(testTopic1, func(*topicindex.Registration) {
+			for i := 0; i < 1000; i++ {
+				reg.sendEvent(topicindex.RegEventTicket, att, nil)
+			}
+		})
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("registration loop blocked sending events")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		test.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by event subscriber")
+	}
+}
+
+func TestTopicBlacklistRegistrar(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic: topicindex.Config{
+			RegLookupInterval:       10 * time.Millisecond,
+			RegLookupIntervalJitter: 1,
+		},
+	})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	test.udp.RegisterTopic(testTopic1, 0)
+	defer test.udp.StopRegisterTopic(testTopic1)
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.Regconfirmation{
+			ReqID:    p.ReqID,
+			Ticket:   []byte{1},
+			WaitTime: 900000,
+		})
+	})
+
+	test.udp.BlacklistRegistrar(testTopic1, ln1.ID())
+	// The node is still in the local table, but must not be used again when the
+	// registration table is refilled from it.
+	time.Sleep(100 * time.Millisecond)
+	st, ok := test.udp.TopicRegistrationStatus(testTopic1)
+	if !ok {
+		t.Fatal("no registration status")
+	}
+	if st.TotalAttempts != 0 {
+		t.Fatalf("%d attempts after blacklisting the only registrar", st.TotalAttempts)
+	}
+}
+
+// This test registers and deregisters many topics concurrently.
+// It is meant to be run with the race detector.
+func TestTopicRegisterMultipleConcurrent(t *testing.T) {
+	test := newUDPV5Test(t, Config{})
+	defer test.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := topicindex.TopicID{byte(i), 1}
+			cancel := test.udp.RegisterTopics([]topicindex.TopicID{topic})
+			test.udp.RegisteredTopics()
+			cancel()
+			cancel()
+		}(i)
+	}
+	wg.Wait()
+
+	if got := test.udp.RegisteredTopics(); len(got) != 0 {
+		t.Fatalf("%d topics still registered", len(got))
+	}
+}
+
+// This test starts and stops registrations and searches while the topic system
+// is shutting down. It is meant to be run with the race detector.
+func TestTopicSystemStopConcurrent(t *testing.T) {
+	test := newUDPV5Test(t, Config{})
+	defer test.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := topicindex.TopicID{byte(i), 2}
+			for j := 0; j < 10; j++ {
+				test.udp.RegisterTopic(topic, 0)
+				it := test.udp.TopicSearch(topic, 0)
+				test.udp.StopRegisterTopic(topic)
+				it.Close()
+			}
+			test.udp.RegisterTopic(topic, 0)
+			test.udp.TopicSearch(topic, 0)
+		}(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	test.udp.Close()
+	wg.Wait()
+
+	if got := test.udp.RegisteredTopics(); len(got) != 0 {
+		t.Fatalf("%d topics still registered after close", len(got))
+	}
+	if got := test.udp.ActiveTopicSearches(); len(got) != 0 {
+		t.Fatalf("%d searches still active after close", len(got))
+	}
+}
+
+// This test checks that registration and search metrics are updated.
+func TestTopicMetrics(t *testing.T) {
+	m := &topicindex.Metrics{
+		RegActive:     new(metrics.StandardGauge),
+		RegSucceeded:  metrics.NewCounterForced(),
+		RegFailed:     metrics.NewCounterForced(),
+		SearchActive:  new(metrics.StandardGauge),
+		SearchResults: metrics.NewCounterForced(),
+		QueryLatency:  metrics.NilTimer{},
+	}
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour, // avoid revalidation
+		Topic:        topicindex.Config{Metrics: m},
+	})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		key2, ln2 = test.createNode(2)
+		_, ln3    = test.createNode(3)
+		found     = ln3.Node()
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	test.table.addSeenNode(wrapNode(ln2.Node()))
+
+	// Register. Only node1 confirms the registration, node2 times out.
+	test.udp.RegisterTopic(testTopic1, 1)
+	if v := m.RegActive.Value(); v != 1 {
+		t.Fatalf("RegActive is %d, want 1", v)
+	}
+	for i := 0; i < 2; i++ {
+		test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+			if addr.IP.Equal(ln1.Node().IP()) {
+				test.packetInFrom(key1, addr, &v5wire.Regconfirmation{ReqID: p.ReqID, WaitTime: 900000})
+			}
+		})
+	}
+	time.Sleep(2 * respTimeoutV5)
+	test.udp.StopRegisterTopic(testTopic1)
+	if v := m.RegActive.Value(); v != 0 {
+		t.Fatalf("RegActive is %d after stop, want 0", v)
+	}
+	if c := m.RegSucceeded.Count(); c != 1 {
+		t.Fatalf("RegSucceeded is %d, want 1", c)
+	}
+	if c := m.RegFailed.Count(); c != 1 {
+		t.Fatalf("RegFailed is %d, want 1", c)
+	}
+
+	// Search. node1 returns one result, node2 returns nothing.
+	it := test.udp.TopicSearch(testTopic1, 2)
+	if v := m.SearchActive.Value(); v != 1 {
+		t.Fatalf("SearchActive is %d, want 1", v)
+	}
+	for i := 0; i < 2; i++ {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			if addr.IP.Equal(ln1.Node().IP()) {
+				test.packetInFrom(key1, addr, &v5wire.TopicNodes{
+					ReqID: p.ReqID,
+					Total: 1,
+					Nodes: []*enr.Record{found.Record()},
+				})
+			} else {
+				test.packetInFrom(key2, addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+			}
+		})
+	}
+	if !it.Next() || it.Node().ID() != found.ID() {
+		t.Fatal("search did not return result")
+	}
+	it.Close()
+	if c := m.SearchResults.Count(); c != 1 {
+		t.Fatalf("SearchResults is %d, want 1", c)
+	}
+	if v := m.SearchActive.Value(); v != 0 {
+		t.Fatalf("SearchActive is %d after close, want 0", v)
+	}
+}
+
+// latencyRecorder is a metrics.Timer which records all observations.
+type latencyRecorder struct {
+	metrics.NilTimer
+	mu  sync.Mutex
+	obs []time.Duration
+}
+
+func (r *latencyRecorder) Update(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.obs = append(r.obs, d)
+}
+
+func (r *latencyRecorder) observations() []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Duration(nil), r.obs...)
+}
+
+// This test checks that query latency is recorded for both answered and
+// timed-out queries.
+func TestTopicSearchQueryLatency(t *testing.T) {
+	var (
+		latency = new(latencyRecorder)
+		m       = &topicindex.Metrics{
+			SearchActive:  metrics.NilGauge{},
+			SearchResults: metrics.NilCounter{},
+			QueryLatency:  latency,
+		}
+		delay   = 300 * time.Millisecond
+		timeout = 500 * time.Millisecond
+	)
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{Metrics: m, SearchQueryTimeout: timeout},
+	})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 0)
+	defer it.Close()
+
+	// The first query is answered after delay, the second one times out.
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		time.Sleep(delay)
+		test.packetInFrom(key1, addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+	})
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {})
+
+	var obs []time.Duration
+	for deadline := time.Now().Add(2 * time.Second); len(obs) < 2; obs = latency.observations() {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d latency observations, want 2", len(obs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if obs[0] < delay || obs[0] >= timeout {
+		t.Errorf("wrong latency %v for answered query, want >= %v", obs[0], delay)
+	}
+	if obs[1] < timeout || obs[1] >= respTimeoutV5+timeout {
+		t.Errorf("wrong latency %v for timed-out query, want >= %v", obs[1], timeout)
+	}
+}
+
+// This test checks that a TOPICQUERY request is canceled after
+// Config.SearchQueryTimeout, and that search continues with another node.
+func TestTopicSearchQueryTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{SearchQueryTimeout: timeout},
+	})
+	defer test.close()
+
+	for i := 1; i <= 2; i++ {
+		_, ln := test.createNode(i)
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+	it := test.udp.TopicSearch(testTopic1, 1)
+
+	// The first query is not answered. The second query should be sent
+	// well before the response timeout of the first one.
+	var (
+		start time.Time
+		addrs []*net.UDPAddr
+	)
+	for len(addrs) < 2 {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			if len(addrs) == 0 {
+				start = time.Now()
+			}
+			addrs = append(addrs, addr)
+		})
+	}
+	if d := time.Since(start); d >= respTimeoutV5 {
+		t.Fatalf("second TOPICQUERY sent after %v, query timeout is %v", d, timeout)
+	}
+	if addrs[0].IP.Equal(addrs[1].IP) {
+		t.Fatal("second TOPICQUERY sent to same node")
+	}
+	it.Close()
+}
+
+// This test checks that TOPICQUERY requests are spaced by at least SearchQueryMinDelay
+// when they are sent one at a time.
+func TestTopicSearchQueryMinDelay(t *testing.T) {
+	const minDelay = 300 * time.Millisecond
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{SearchQueryMinDelay: minDelay, SearchQueryBatchSize: 1},
+	})
+	defer test.close()
+
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for i := 1; i <= 3; i++ {
+		key, ln := test.createNode(i)
+		keys[string(ln.Node().IP())] = key
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+	it := test.udp.TopicSearch(testTopic1, 1)
+	defer it.Close()
+
+	// All queries are answered immediately.
+	var times []time.Time
+	for len(times) < 3 {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			times = append(times, time.Now())
+			test.packetInFrom(keys[string(addr.IP)], addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+		})
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < minDelay-10*time.Millisecond {
+			t.Fatalf("query %d sent %v after previous one, want at least %v", i, d, minDelay)
+		}
+	}
+}
+
+// This test checks that topic search queries nodes which are added to the main
+// node table while the search is running.
+func TestTopicSearchNodeTableUpdates(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		// Disable rollover, node2 must arrive through the table subscription.
+		Topic: topicindex.Config{SearchLookupMinDelay: time.Hour, SearchQueryMinDelay: 10 * time.Millisecond},
+	})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		key2, ln2 = test.createNode(2)
+		keys      = map[string]*ecdsa.PrivateKey{
+			string(ln1.Node().IP()): key1,
+			string(ln2.Node().IP()): key2,
+		}
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	it := test.udp.TopicSearch(testTopic1, 1)
+	defer it.Close()
+
+	// Simulate node2 passing revalidation in the main table.
+	test.table.nodeFeed.Send(ln2.Node())
+
+	queried := make(map[string]bool)
+	for len(queried) < 2 {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			// Hold the response until the search has received node2, so it
+			// can't run out of nodes in the meantime.
+			waitNewNodesConsumed(t, test.udp.topicSys)
+			queried[string(addr.IP)] = true
+			test.packetInFrom(keys[string(addr.IP)], addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+		})
+	}
+}
+
+// waitNewNodesConsumed waits until all searches have read their node table
+// subscription channel.
+func waitNewNodesConsumed(t *testing.T, sys *topicSystem) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		sys.mu.Lock()
+		pending := 0
+		for s := range sys.search {
+			pending += len(s.newNodesCh)
+		}
+		sys.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("search did not consume new nodes")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// This test checks that canceling the context of an iterator created by
+// WithContext ends that iterator, but does not stop the search.
+func TestTopicSearchIteratorWithContext(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		_, ln2    = test.createNode(2)
+		found     = ln2.Node()
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 1)
+	defer it.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctxIt := it.(*topicSearchIterator).WithContext(ctx)
+	defer ctxIt.Close()
+
+	cancel()
+	if ctxIt.Next() {
+		t.Fatal("Next returned true after context was canceled")
+	}
+
+	// The search should still deliver results to the original iterator.
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.TopicNodes{
+			ReqID: p.ReqID,
+			Total: 1,
+			Nodes: []*enr.Record{found.Record()},
+		})
+	})
+	if !it.Next() || it.Node().ID() != found.ID() {
+		t.Fatal("search did not return result after context was canceled")
+	}
+}
+
+// This test checks that registration and search started with a context end when
+// the context is canceled.
+func TestTopicContextCancel(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	waitTopics := func(get func() []topicindex.TopicID, want int) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); len(get()) != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d active topics, want %d", len(get()), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Registration stops when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := test.udp.RegisterTopicContext(ctx, testTopic1, 0); err != nil {
+		t.Fatal("RegisterTopicContext failed:", err)
+	}
+	if err := test.udp.RegisterTopicContext(ctx, testTopic1, 0); err != nil {
+		t.Fatal("duplicate RegisterTopicContext failed:", err)
+	}
+	cancel()
+	waitTopics(test.udp.RegisteredTopics, 0)
+	if err := test.udp.RegisterTopicContext(ctx, testTopic1, 0); err != context.Canceled {
+		t.Fatalf("wrong error for canceled context: %v", err)
+	}
+
+	// Canceling the context doesn't stop a later registration of the same topic.
+	ctx, cancel = context.WithCancel(context.Background())
+	test.udp.RegisterTopicContext(ctx, testTopic1, 0)
+	test.udp.StopRegisterTopic(testTopic1)
+	test.udp.RegisterTopic(testTopic1, 0)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if len(test.udp.RegisteredTopics()) != 1 {
+		t.Fatal("canceling context stopped unrelated registration")
+	}
+	test.udp.StopRegisterTopic(testTopic1)
+
+	// The search ends when the context is canceled.
+	ctx, cancel = context.WithCancel(context.Background())
+	it := test.udp.TopicSearchContext(ctx, testTopic1, 0)
+	defer it.Close()
+	waitTopics(test.udp.ActiveTopicSearches, 1)
+	cancel()
+	if it.Next() {
+		t.Fatal("Next returned true after context was canceled")
+	}
+	waitTopics(test.udp.ActiveTopicSearches, 0)
+}
+
+// This test checks that the iterator returned by WithFilter only yields matching
+// results, and that closing it stops the search.
+func TestTopicSearchIteratorWithFilter(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		_, ln2    = test.createNode(2)
+		_, ln3    = test.createNode(3)
+	)
+	ln3.Set(enr.WithEntry("testkey", uint(1)))
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 1).(*topicSearchIterator)
+	fit := it.WithFilter(func(n *enode.Node) bool {
+		var v uint
+		return n.Load(enr.WithEntry("testkey", &v)) == nil
+	})
+	defer fit.Close()
+
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.TopicNodes{
+			ReqID: p.ReqID,
+			Total: 1,
+			Nodes: []*enr.Record{ln2.Node().Record(), ln3.Node().Record()},
+		})
+	})
+	if !fit.Next() {
+		t.Fatal("no result")
+	}
+	if id := fit.Node().ID(); id != ln3.ID() {
+		t.Fatalf("wrong result %v, want %v", id, ln3.ID())
+	}
+
+	// Closing the filter iterator stops the search.
+	fit.Close()
+	if got := test.udp.ActiveTopicSearches(); len(got) != 0 {
+		t.Fatalf("search still active after close: %x", got)
+	}
+}
+
+// This test checks that topic search starts over when all known nodes have been asked.
+func TestTopicSearchRestart(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 0)
+	defer it.Close()
+	for i := 0; i < 2; i++ {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			test.packetInFrom(key1, addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+		})
+	}
+}
+
+// This test checks that search rounds are not delayed when SearchLookupMinDelay
+// is negative.
+func TestTopicSearchLookupMinDelay(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{SearchLookupMinDelay: -1},
+	})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 0)
+	defer it.Close()
+
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			times = append(times, time.Now())
+			test.packetInFrom(key1, addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+		})
+	}
+	// With the default delay, rounds would be two seconds apart.
+	if d := times[2].Sub(times[0]); d >= 2*time.Second {
+		t.Fatalf("search rounds took %v", d)
+	}
+}
+
+func TestTopicSearchIteratorPeek(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		_, ln2    = test.createNode(2)
+		_, ln3    = test.createNode(3)
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	it := test.udp.TopicSearch(testTopic1, 2).(*topicSearchIterator)
+	defer it.Close()
+	if n := it.Peek(); n != nil {
+		t.Fatal("Peek returned node before any results:", n.ID())
+	}
+
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(key1, addr, &v5wire.TopicNodes{
+			ReqID: p.ReqID,
+			Total: 1,
+			Nodes: []*enr.Record{ln2.Node().Record(), ln3.Node().Record()},
+		})
+	})
+
+	// Wait for the first result to arrive.
+	var first *enode.Node
+	for start := time.Now(); first == nil; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("no result buffered")
+		}
+		first = it.Peek()
+	}
+	for i := 0; i < 3; i++ {
+		if n := it.Peek(); n != first {
+			t.Fatalf("Peek returned different node %v, want %v", n.ID(), first.ID())
+		}
+		if it.Node() != nil {
+			t.Fatal("Peek changed Node")
+		}
+	}
+	if !it.Next() || it.Node() != first {
+		t.Fatal("Next did not move to peeked node")
+	}
+	if !it.Next() || it.Node() == first {
+		t.Fatal("Next did not move to second result")
+	}
+}
+
 // This is an end-to-end test of topic search.
 func TestTopicSearch(t *testing.T) {
 	topic := topicindex.TopicID{1, 1, 1, 1}
@@ -131,8 +1332,8 @@ func TestTopicSearch(t *testing.T) {
 	}()
 
 	// Add registrations of two other nodes in the topic table of node1.
-	node1.topicTable.Add(node0.Self(), topic)
-	node1.topicTable.Add(node3.Self(), topic)
+	addTopicNode(node1, node0.Self(), topic)
+	addTopicNode(node1, node3.Self(), topic)
 
 	// Attempt to discover the registrations from yet another node.
 	it := node2.TopicSearch(topic, 0)
@@ -140,3 +1341,580 @@ func TestTopicSearch(t *testing.T) {
 	nodes := enode.ReadNodes(it, 2)
 	t.Log("found nodes:", nodes)
 }
+
+// This test checks that Config.SearchWarmUpFindnode sends FINDNODE for distance
+// zero before the topic query.
+func TestTopicSearchWarmUp(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{SearchWarmUpFindnode: true},
+	})
+	defer test.close()
+
+	key1, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	it := test.udp.TopicSearch(testTopic1, 1)
+	defer it.Close()
+
+	test.waitPacketOut(func(p *v5wire.Findnode, addr *net.UDPAddr, _ v5wire.Nonce) {
+		if !reflect.DeepEqual(p.Distances, []uint{0}) {
+			t.Errorf("wrong FINDNODE distances %v", p.Distances)
+		}
+		test.packetInFrom(key1, addr, &v5wire.Nodes{ReqID: p.ReqID, Total: 1, Nodes: []*enr.Record{ln1.Node().Record()}})
+	})
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		if p.Topic != testTopic1 {
+			t.Errorf("wrong topic %x in TOPICQUERY", p.Topic)
+		}
+	})
+}
+
+// This test checks that closing the search iterator aborts a pending FINDNODE
+// warm-up request instead of waiting for its timeout.
+func TestTopicSearchWarmUpClose(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{SearchWarmUpFindnode: true},
+	})
+	defer test.close()
+
+	_, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	it := test.udp.TopicSearch(testTopic1, 1)
+
+	// The FINDNODE request is not answered.
+	test.waitPacketOut(func(p *v5wire.Findnode, addr *net.UDPAddr, _ v5wire.Nonce) {})
+	start := time.Now()
+	it.Close()
+	if d := time.Since(start); d >= respTimeoutV5/2 {
+		t.Fatalf("Close took %v, want < %v", d, respTimeoutV5/2)
+	}
+}
+
+// This test runs a search with Config.SearchWarmUpFindnode between two nodes which
+// have never seen each other. The queried node is known to the searcher only as
+// a seed node. The bootnode is needed because search doesn't start while the
+// local table is empty.
+func TestTopicSearchWarmUpEndToEnd(t *testing.T) {
+	bootnode := startLocalhostV5(t, Config{})
+	defer bootnode.Close()
+	registrar := startLocalhostV5(t, Config{})
+	defer registrar.Close()
+	addTopicNode(registrar, registrar.Self(), testTopic1)
+
+	searcher := startLocalhostV5(t, Config{
+		Bootnodes: []*enode.Node{bootnode.Self()},
+		Topic: topicindex.Config{
+			SearchWarmUpFindnode: true,
+			SearchSeedNodes:      []*enode.Node{registrar.Self()},
+		},
+	})
+	defer searcher.Close()
+
+	it := searcher.TopicSearch(testTopic1, 1)
+	defer it.Close()
+	nodes := enode.ReadNodes(it, 1)
+	if len(nodes) != 1 || nodes[0].ID() != registrar.Self().ID() {
+		t.Fatalf("wrong search results %v", nodes)
+	}
+}
+
+// addTopicNode adds a registration to the topic table of t. The table is modified
+// on the dispatch goroutine, which owns it.
+func addTopicNode(t *UDPv5, n *enode.Node, topic topicindex.TopicID) {
+	done := make(chan struct{})
+	t.onDispatchCh <- func() {
+		t.topicTable.Add(n, topic)
+		close(done)
+	}
+	<-done
+}
+
+// This benchmark measures how long topic search is blocked delivering results to a
+// slow iterator consumer. Results arrive in bursts, as they do when a TOPICQUERY
+// response is processed.
+func BenchmarkTopicSearchIteratorBuffer(b *testing.B) {
+	for _, size := range []int{200, 2000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			const burst = 1000
+			var (
+				cfg     = topicindex.Config{SearchIteratorBufferSize: size}.WithDefaults()
+				ch      = make(chan *enode.Node, cfg.SearchIteratorBufferSize)
+				node    = enode.SignNull(new(enr.Record), enode.ID{})
+				blocked time.Duration
+				done    = make(chan struct{})
+			)
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					if _, ok := <-ch; !ok {
+						return
+					}
+					if i%100 == 0 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%burst == 0 {
+					time.Sleep(20 * time.Millisecond)
+				}
+				start := time.Now()
+				ch <- node
+				blocked += time.Since(start)
+			}
+			close(ch)
+			<-done
+			b.ReportMetric(float64(blocked.Nanoseconds())/float64(b.N), "blocked-ns/op")
+		})
+	}
+}
+
+// This benchmark compares sequential and batched TOPICQUERY dispatch. Each operation
+// queries a search space of 100 localhost nodes.
+func BenchmarkTopicSearchQueryBatch(b *testing.B) {
+	const numNodes = 100
+	var (
+		nodes  []*enode.Node
+		logger = log.New()
+	)
+	logger.SetHandler(log.DiscardHandler())
+	for i := 0; i < numNodes; i++ {
+		udp := startBenchmarkV5(b, Config{Log: logger})
+		defer udp.Close()
+		nodes = append(nodes, udp.Self())
+	}
+
+	for _, size := range []int{1, 4} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			client := startBenchmarkV5(b, Config{
+				Log: logger,
+				Topic: topicindex.Config{
+					SearchBucketSize:     numNodes,
+					SearchQueryMinDelay:  time.Millisecond,
+					SearchQueryBatchSize: size,
+				},
+			})
+			defer client.Close()
+
+			sys := client.topicSys
+			s := &topicSearch{
+				topic:       testTopic1,
+				config:      sys.config,
+				quit:        make(chan struct{}),
+				queryCh:     make(chan *enode.Node, size),
+				queryRespCh: make(chan topicQueryResult),
+			}
+			s.wg.Add(1)
+			go s.runRequests(sys)
+			defer s.wg.Wait()
+			defer close(s.quit)
+			defer close(s.queryCh)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				state := topicindex.NewSearchFromNodes(s.topic, s.config, nodes)
+				for state.Stats().Asked < numNodes {
+					s.startQueries(state)
+					if s.queryCount == 0 {
+						time.Sleep(time.Duration(state.NextQueryTime() - sys.config.Clock.Now()))
+						continue
+					}
+					resp := <-s.queryRespCh
+					s.queryCount--
+					state.AddQueryResults(resp.src, resp.topicNodes)
+				}
+			}
+		})
+	}
+}
+
+// startBenchmarkV5 is like startLocalhostV5, but uses the logger of cfg.
+func startBenchmarkV5(b *testing.B, cfg Config) *UDPv5 {
+	cfg.PrivateKey = newkey()
+	db, _ := enode.OpenDB("")
+	ln := enode.NewLocalNode(db, cfg.PrivateKey)
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	realaddr := socket.LocalAddr().(*net.UDPAddr)
+	ln.SetStaticIP(realaddr.IP)
+	ln.SetFallbackUDP(realaddr.Port)
+	udp, err := ListenV5(socket, ln, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return udp
+}
+
+// This test checks that the Done channel of a search iterator is closed when the
+// iterator is closed and when the topic system shuts down.
+func TestTopicSearchIteratorDone(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	waitDone := func(it *topicSearchIterator) {
+		t.Helper()
+		select {
+		case <-it.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done channel not closed")
+		}
+	}
+
+	it1 := test.udp.TopicSearch(testTopic1, 0).(*topicSearchIterator)
+	it2 := test.udp.TopicSearch(testTopic1, 0).(*topicSearchIterator)
+	defer it2.Close()
+	select {
+	case <-it1.Done():
+		t.Fatal("Done channel closed before Close")
+	default:
+	}
+	it1.Close()
+	waitDone(it1)
+	select {
+	case <-it2.Done():
+		t.Fatal("closing one iterator closed Done of another")
+	default:
+	}
+
+	test.udp.topicSys.stop()
+	waitDone(it2)
+}
+
+// This test checks that SearchTopics returns the results of all topic searches.
+func TestTopicSearchMultiple(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		topics    = []topicindex.TopicID{{1}, {2}, {3}}
+		results   = make(map[topicindex.TopicID]*enode.Node)
+	)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	for i, topic := range topics {
+		_, ln := test.createNode(2 + i)
+		results[topic] = ln.Node()
+	}
+
+	it := test.udp.SearchTopics(topics)
+	defer it.Close()
+
+	// Answer the query of each search with a topic-specific result.
+	for range topics {
+		test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+			n := results[p.Topic]
+			if n == nil {
+				t.Fatalf("query for unexpected topic %x", p.Topic)
+			}
+			test.packetInFrom(key1, addr, &v5wire.TopicNodes{
+				ReqID: p.ReqID,
+				Total: 1,
+				Nodes: []*enr.Record{n.Record()},
+			})
+		})
+	}
+
+	found := make(map[enode.ID]bool)
+	for len(found) < len(topics) {
+		if !it.Next() {
+			t.Fatal("iterator ended early")
+		}
+		found[it.Node().ID()] = true
+	}
+	for topic, n := range results {
+		if !found[n.ID()] {
+			t.Errorf("result for topic %x missing", topic[:1])
+		}
+	}
+
+	// Closing the merged iterator stops all searches.
+	it.Close()
+	if it.Next() {
+		t.Fatal("Next returned true after Close")
+	}
+	if n := len(test.udp.ActiveTopicSearches()); n != 0 {
+		t.Fatalf("%d searches active after Close", n)
+	}
+}
+
+// This test checks that stopping registration aborts in-flight REGTOPIC requests
+// instead of waiting for the response timeout.
+func TestTopicRegStopCancelsRequests(t *testing.T) {
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Topic:        topicindex.Config{RegInitialJitter: -1},
+	})
+	defer test.close()
+
+	_, ln1 := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+
+	test.udp.RegisterTopic(testTopic1, 0)
+	test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {})
+
+	// The request is still waiting for a response.
+	start := time.Now()
+	test.udp.StopRegisterTopic(testTopic1)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("stopping registration took %v", d)
+	}
+}
+
+// This test checks that TopicRegistrationExpiry reports the expiry time of the
+// earliest registered ad.
+func TestTopicRegistrationExpiry(t *testing.T) {
+	clock := new(mclock.Simulated)
+	test := newUDPV5Test(t, Config{
+		PingInterval: time.Hour,
+		Clock:        clock,
+		Topic:        topicindex.Config{RegInitialJitter: -1},
+	})
+	defer test.close()
+
+	_, ln := test.createNode(1)
+	test.table.addSeenNode(wrapNode(ln.Node()))
+	if _, ok := test.udp.TopicRegistrationExpiry(testTopic1); ok {
+		t.Fatal("expiry reported for topic which is not registered")
+	}
+	test.udp.RegisterTopic(testTopic1, 1)
+	defer test.udp.StopRegisterTopic(testTopic1)
+	if _, ok := test.udp.TopicRegistrationExpiry(testTopic1); ok {
+		t.Fatal("expiry reported before registration succeeded")
+	}
+
+	const lifetime = time.Minute
+	ok := test.udp.topicSys.withRegState(testTopic1, func(state *topicindex.Registration) {
+		att := state.Update()
+		state.StartRequest(att)
+		state.HandleRegistered(att, lifetime)
+	})
+	if !ok {
+		t.Fatal("registration not running")
+	}
+	want := clock.Now().Add(lifetime)
+	clock.Run(lifetime / 2)
+	exp, ok := test.udp.TopicRegistrationExpiry(testTopic1)
+	if !ok {
+		t.Fatal("no expiry reported after registration")
+	}
+	if exp != want {
+		t.Fatalf("wrong expiry %v, want %v", exp, want)
+	}
+}
+
+// This test checks that isRunning is cleared when a registration stops, and that
+// stopping registrations are not reported as active while other goroutines
+// query the active topics.
+func TestTopicRegIsRunning(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+	sys := test.udp.topicSys
+
+	var topics []topicindex.TopicID
+	for i := 0; i < 8; i++ {
+		topic := topicindex.TopicID{byte(i)}
+		topics = append(topics, topic)
+		test.udp.RegisterTopic(topic, 0)
+	}
+	sys.mu.Lock()
+	regs := make([]*topicReg, 0, len(sys.reg))
+	for _, reg := range sys.reg {
+		regs = append(regs, reg)
+	}
+	sys.mu.Unlock()
+	for _, reg := range regs {
+		if !reg.isRunning() {
+			t.Fatalf("registration of %x not running", reg.state.Topic())
+		}
+	}
+
+	// Stop all registrations concurrently while querying the active topics.
+	var (
+		queryWG sync.WaitGroup
+		stopWG  sync.WaitGroup
+		done    = make(chan struct{})
+	)
+	queryWG.Add(1)
+	go func() {
+		defer queryWG.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if active := test.udp.RegisteredTopics(); len(active) > len(topics) {
+					t.Errorf("too many active registrations: %d", len(active))
+				}
+			}
+		}
+	}()
+	stopWG.Add(len(topics))
+	for _, topic := range topics {
+		go func(topic topicindex.TopicID) {
+			defer stopWG.Done()
+			test.udp.StopRegisterTopic(topic)
+		}(topic)
+	}
+	stopWG.Wait()
+	close(done)
+	queryWG.Wait()
+
+	for _, reg := range regs {
+		if reg.isRunning() {
+			t.Fatalf("registration of %x still running after stop", reg.state.Topic())
+		}
+	}
+	if active := test.udp.RegisteredTopics(); len(active) != 0 {
+		t.Fatalf("active registrations after stop: %x", active)
+	}
+
+	// When the topic system shuts down, registrations remain in sys.reg, but they
+	// aren't reported as active anymore.
+	test.udp.RegisterTopic(topics[0], 0)
+	sys.stop()
+	if active := test.udp.RegisteredTopics(); len(active) != 0 {
+		t.Fatalf("active registrations after shutdown: %x", active)
+	}
+}
+
+// This test checks that WaitForRegistration returns when the requested number of
+// registrars have accepted the ad.
+func TestTopicWaitForRegistration(t *testing.T) {
+	test := newUDPV5Test(t, Config{PingInterval: time.Hour})
+	defer test.close()
+
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for i := 1; i <= 3; i++ {
+		key, ln := test.createNode(i)
+		keys[string(ln.Node().IP())] = key
+		test.table.addSeenNode(wrapNode(ln.Node()))
+	}
+
+	// The wait can start before registration.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- test.udp.WaitForRegistration(ctx, testTopic1, 2) }()
+
+	test.udp.RegisterTopic(testTopic1, 0)
+	defer test.udp.StopRegisterTopic(testTopic1)
+
+	// Accept the ad on two of the three nodes. The third one doesn't respond.
+	accepted := make(map[string]bool)
+	for len(accepted) < 2 {
+		select {
+		case err := <-result:
+			t.Fatalf("WaitForRegistration returned %v after %d registrations", err, len(accepted))
+		default:
+		}
+		test.waitPacketOut(func(p *v5wire.Regtopic, addr *net.UDPAddr, _ v5wire.Nonce) {
+			ip := string(addr.IP)
+			if len(accepted) == 0 && len(keys) == 3 {
+				delete(keys, ip) // first node stays silent
+				return
+			}
+			if key, ok := keys[ip]; ok && !accepted[ip] {
+				accepted[ip] = true
+				test.packetInFrom(key, addr, &v5wire.Regconfirmation{ReqID: p.ReqID, WaitTime: 900000})
+				if len(accepted) == 1 {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		})
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal("WaitForRegistration error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForRegistration did not return")
+	}
+
+	// Waiting for more registrations than possible ends with the context.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := test.udp.WaitForRegistration(ctx2, testTopic1, 3); err != context.DeadlineExceeded {
+		t.Fatalf("wrong error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// This test checks that Config.SearchResultCallback runs on CallbackWorkers
+// goroutines without blocking the search, and that it isn't called after the
+// search has stopped.
+func TestTopicSearchResultCallback(t *testing.T) {
+	var (
+		calls   int32
+		entered = make(chan *enode.Node, 10)
+		release = make(chan struct{})
+		cfg     = Config{PingInterval: time.Hour}
+	)
+	cfg.Topic.CallbackWorkers = 2
+	cfg.Topic.SearchQueryBatchSize = 1
+	cfg.Topic.SearchQueryMinDelay = 10 * time.Millisecond
+	cfg.Topic.SearchResultCallback = func(topic topicindex.TopicID, n *enode.Node) {
+		if topic != testTopic1 {
+			t.Errorf("callback for wrong topic %x", topic)
+		}
+		atomic.AddInt32(&calls, 1)
+		entered <- n
+		<-release
+	}
+	test := newUDPV5Test(t, cfg)
+	defer test.close()
+
+	var (
+		key1, ln1 = test.createNode(1)
+		key2, ln2 = test.createNode(2)
+		keys      = map[string]*ecdsa.PrivateKey{
+			string(ln1.Node().IP()): key1,
+			string(ln2.Node().IP()): key2,
+		}
+		results []*enr.Record
+	)
+	for i := 3; i < 6; i++ {
+		_, ln := test.createNode(i)
+		results = append(results, ln.Node().Record())
+	}
+	test.table.addSeenNode(wrapNode(ln1.Node()))
+	test.table.addSeenNode(wrapNode(ln2.Node()))
+	it := test.udp.TopicSearch(testTopic1, 1)
+
+	// The first query returns three results. Two of them block in the callback.
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(keys[string(addr.IP)], addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1, Nodes: results})
+	})
+	for i := 0; i < cfg.Topic.CallbackWorkers; i++ {
+		select {
+		case <-entered:
+		case <-time.After(time.Second):
+			t.Fatalf("callback %d not called", i)
+		}
+	}
+	// The search goes on while the callbacks are blocked.
+	test.waitPacketOut(func(p *v5wire.TopicQuery, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetInFrom(keys[string(addr.IP)], addr, &v5wire.TopicNodes{ReqID: p.ReqID, Total: 1})
+	})
+	if n := atomic.LoadInt32(&calls); n != int32(cfg.Topic.CallbackWorkers) {
+		t.Fatalf("%d callbacks running, want %d", n, cfg.Topic.CallbackWorkers)
+	}
+
+	// Stop the search. The third result must not be delivered.
+	closed := make(chan struct{})
+	go func() {
+		it.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-closed
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != int32(cfg.Topic.CallbackWorkers) {
+		t.Fatalf("callback called %d times after stop", n-int32(cfg.Topic.CallbackWorkers))
+	}
+}
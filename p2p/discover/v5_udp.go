@@ -265,16 +265,93 @@ func (t *UDPv5) AllNodes() []*enode.Node {
 	return nodes
 }
 
-// RegisterTopic adds a topic for registration.
+// RegisterTopic adds a topic for registration. Registrations are reference-counted:
+// every call must be paired with a call to StopRegisterTopic.
 func (t *UDPv5) RegisterTopic(topic topicindex.TopicID, opid uint64) {
 	t.topicSys.register(topic, opid)
 }
 
-// StopRegisterTopic removes a topic from registration.
+// RegisterTopicContext adds a topic for registration. The reference taken by this
+// call is released when ctx is done.
+func (t *UDPv5) RegisterTopicContext(ctx context.Context, topic topicindex.TopicID, opid uint64) error {
+	return t.topicSys.registerContext(ctx, topic, opid)
+}
+
+// StopRegisterTopic releases a reference taken by RegisterTopic. Registration
+// of the topic stops when all references are released.
 func (t *UDPv5) StopRegisterTopic(topic topicindex.TopicID) {
 	t.topicSys.stopRegister(topic)
 }
 
+// RegisterTopics starts registration for multiple topics at once. The returned
+// function releases the references taken by this call, stopping registration of
+// topics which aren't registered by anyone else. It is safe to call it more
+// than once.
+func (t *UDPv5) RegisterTopics(topics []topicindex.TopicID) (cancel func()) {
+	var (
+		acquired = t.topicSys.registerAll(topics, 0)
+		once     sync.Once
+	)
+	return func() {
+		once.Do(func() { t.topicSys.stopRegisterAll(acquired) })
+	}
+}
+
+// RegisteredTopics returns the topics currently being registered, sorted by ID.
+func (t *UDPv5) RegisteredTopics() []topicindex.TopicID {
+	return t.topicSys.registeredTopics()
+}
+
+// ActiveTopicSearches returns the topics of all running searches, sorted by ID.
+func (t *UDPv5) ActiveTopicSearches() []topicindex.TopicID {
+	return t.topicSys.searchedTopics()
+}
+
+// TopicRegistrationStatus returns the registration statistics of a topic.
+// The boolean result is false if the topic is not being registered.
+func (t *UDPv5) TopicRegistrationStatus(topic topicindex.TopicID) (topicindex.RegStats, bool) {
+	return t.topicSys.regStats(topic)
+}
+
+// TopicRegistrationExpiry returns the time when the earliest ad of a topic expires
+// and must be renewed. The time is measured on Config.Clock. The boolean result is
+// false if the topic is not being registered or no ad is currently registered.
+func (t *UDPv5) TopicRegistrationExpiry(topic topicindex.TopicID) (mclock.AbsTime, bool) {
+	return t.topicSys.regExpiry(topic)
+}
+
+// TopicRegistrationSnapshot returns the registration table of a topic. This is
+// meant for debugging. The boolean result is false if the topic is not being
+// registered.
+func (t *UDPv5) TopicRegistrationSnapshot(topic topicindex.TopicID) ([]topicindex.RegBucketInfo, bool) {
+	return t.topicSys.regSnapshot(topic)
+}
+
+// TopicRegEvents subscribes to the registration events of a topic. The subscription
+// can be created before registration of the topic starts, and remains valid when
+// registration is stopped and restarted. Registration doesn't wait for the
+// subscriber: events are dropped while the channel buffer is full. Call the
+// returned function to end the subscription.
+func (t *UDPv5) TopicRegEvents(topic topicindex.TopicID) (<-chan topicindex.RegEvent, func()) {
+	ch := make(chan topicindex.RegEvent, 64)
+	sub := t.topicSys.subscribeRegEvents(topic, ch)
+	return ch, sub.Unsubscribe
+}
+
+// WaitForRegistration blocks until at least minCount nodes have accepted an ad
+// for the topic. It returns ctx.Err() if the context is done first. Note that
+// this does not start registration of the topic, use RegisterTopic for that.
+func (t *UDPv5) WaitForRegistration(ctx context.Context, topic topicindex.TopicID, minCount int) error {
+	return t.topicSys.waitRegistered(ctx, topic, minCount)
+}
+
+// BlacklistRegistrar stops registration of a topic on the given node. The node
+// is not used as a registrar for the topic again until Config.Topic.RegBlacklistTTL
+// has passed.
+func (t *UDPv5) BlacklistRegistrar(topic topicindex.TopicID, id enode.ID) {
+	t.topicSys.blacklistRegistrar(topic, id)
+}
+
 // LocalTopicNodes returns all locally-registered nodes for a topic.
 func (t *UDPv5) LocalTopicNodes(topic topicindex.TopicID) []*enode.Node {
 	done := make(chan []*enode.Node, 1)
@@ -292,6 +369,22 @@ func (t *UDPv5) TopicSearch(topic topicindex.TopicID, opid uint64) enode.Iterato
 	return t.topicSys.newSearchIterator(topic, opid)
 }
 
+// TopicSearchContext is like TopicSearch, but the search also ends when ctx is
+// done. The iterator should still be closed by the caller.
+func (t *UDPv5) TopicSearchContext(ctx context.Context, topic topicindex.TopicID, opid uint64) enode.Iterator {
+	return t.topicSys.newSearchIteratorContext(ctx, topic, opid)
+}
+
+// SearchTopics searches for multiple topics at once. The returned iterator yields
+// the results of all searches. Closing it stops all searches.
+func (t *UDPv5) SearchTopics(topics []topicindex.TopicID) enode.Iterator {
+	its := make([]enode.Iterator, len(topics))
+	for i, topic := range topics {
+		its[i] = t.topicSys.newSearchIterator(topic, 0)
+	}
+	return newMergedIterator(its)
+}
+
 // RegisterTalkHandler adds a handler for 'talk requests'. The handler function is called
 // whenever a request for the given protocol is received and should return the response
 // data or nil.
@@ -421,6 +514,11 @@ func (t *UDPv5) RequestENR(n *enode.Node) (*enode.Node, error) {
 
 // findnode calls FINDNODE on a node and waits for responses.
 func (t *UDPv5) findnode(n *enode.Node, distances []uint, opid uint64) ([]*enode.Node, error) {
+	return t.findnodeContext(context.Background(), n, distances, opid)
+}
+
+// findnodeContext is like findnode, but stops waiting when ctx is done.
+func (t *UDPv5) findnodeContext(ctx context.Context, n *enode.Node, distances []uint, opid uint64) ([]*enode.Node, error) {
 	req := &v5wire.Findnode{Distances: distances, OpID: opid}
 	c := t.call(n, req, v5wire.NodesMsg)
 	defer t.callDone(c)
@@ -437,13 +535,16 @@ func (t *UDPv5) findnode(n *enode.Node, distances []uint, opid uint64) ([]*enode
 			proc.addResponse()
 			proc.addNodes(n, resp.Nodes, resp.Name())
 		case err = <-c.err:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 	}
 	return proc.result(), err
 }
 
-// regtopic sends REGTOPIC to n and waits for responses.
-func (t *UDPv5) regtopic(n *enode.Node, topic topicindex.TopicID, ticket []byte, opid uint64) topicRegResult {
+// regtopic sends REGTOPIC to n and waits for responses. It returns early when ctx
+// is canceled.
+func (t *UDPv5) regtopic(ctx context.Context, n *enode.Node, topic topicindex.TopicID, ticket []byte, opid uint64) topicRegResult {
 	req := &v5wire.Regtopic{
 		Topic:  topic,
 		Ticket: ticket,
@@ -474,6 +575,8 @@ func (t *UDPv5) regtopic(n *enode.Node, topic topicindex.TopicID, ticket []byte,
 			}
 		case err := <-c.err:
 			result.err = err
+		case <-ctx.Done():
+			result.err = ctx.Err()
 		}
 	}
 	result.nodes = proc.result()
@@ -481,7 +584,7 @@ func (t *UDPv5) regtopic(n *enode.Node, topic topicindex.TopicID, ticket []byte,
 }
 
 // topicQuery sends TOPICQUERY and waits for one or more NODES responses.
-func (t *UDPv5) topicQuery(n *enode.Node, topic topicindex.TopicID, opid uint64) topicQueryResult {
+func (t *UDPv5) topicQuery(ctx context.Context, n *enode.Node, topic topicindex.TopicID, opid uint64) topicQueryResult {
 	req := &v5wire.TopicQuery{Topic: topic, OpID: opid}
 	c := t.call(n, req, 0)
 	defer t.callDone(c)
@@ -510,6 +613,8 @@ func (t *UDPv5) topicQuery(n *enode.Node, topic topicindex.TopicID, opid uint64)
 		case err := <-c.err:
 			fmt.Println("error! recvnodes", nodesProc.received, "recvtop", topicProc.received)
 			result.err = err
+		case <-ctx.Done():
+			result.err = ctx.Err()
 		}
 	}
 	result.topicNodes = topicProc.result()
@@ -578,13 +683,10 @@ func (t *UDPv5) dispatch() {
 	t.readNextCh <- struct{}{}
 
 	for {
-		nextExp := t.topicTable.NextExpiryTime()
-		if nextExp != topicindex.Never {
-			topicExp.Schedule(nextExp)
-		}
+		expCh := scheduleAlarm(topicExp, t.topicTable.NextExpiryTime())
 
 		select {
-		case <-topicExp.C():
+		case <-expCh:
 			t.topicTable.Expire()
 
 		case fn := <-t.onDispatchCh:
@@ -604,13 +706,16 @@ func (t *UDPv5) dispatch() {
 		case c := <-t.callDoneCh:
 			id := c.node.ID()
 			active := t.activeCallByNode[id]
-			if active != c {
+			if active == c {
+				c.timeout.Stop()
+				delete(t.activeCallByAuth, c.nonce)
+				delete(t.activeCallByNode, id)
+				t.sendNextCall(id)
+			} else if !t.removeQueuedCall(c) {
+				// Only queued calls can be abandoned before they are
+				// sent, e.g. when their context is canceled.
 				panic("BUG: callDone for inactive call")
 			}
-			c.timeout.Stop()
-			delete(t.activeCallByAuth, c.nonce)
-			delete(t.activeCallByNode, id)
-			t.sendNextCall(id)
 
 		case p := <-t.packetInCh:
 			t.handlePacket(p.Data, p.Addr)
@@ -671,6 +776,24 @@ func (t *UDPv5) sendNextCall(id enode.ID) {
 	}
 }
 
+// removeQueuedCall removes a call which hasn't been sent yet from the queue.
+func (t *UDPv5) removeQueuedCall(c *callV5) bool {
+	id := c.node.ID()
+	queue := t.callQueue[id]
+	for i := range queue {
+		if queue[i] == c {
+			queue = append(queue[:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(t.callQueue, id)
+			} else {
+				t.callQueue[id] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
 // sendCall encodes and sends a request packet to the call's recipient node.
 // This performs a handshake if needed.
 func (t *UDPv5) sendCall(c *callV5) {
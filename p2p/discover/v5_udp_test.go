@@ -18,6 +18,7 @@ package discover
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
 	"fmt"
@@ -335,7 +336,7 @@ func TestUDPv5_topicqueryCall(t *testing.T) {
 	)
 	go func() {
 		var err error
-		response = test.udp.topicQuery(remote, topic, 0)
+		response = test.udp.topicQuery(context.Background(), remote, topic, 0)
 		done <- err
 	}()
 
@@ -480,6 +481,45 @@ func TestUDPv5_callTimeoutReset(t *testing.T) {
 	}
 }
 
+// This test checks that a queued call can be abandoned before it is sent.
+func TestUDPv5_callDoneQueued(t *testing.T) {
+	t.Parallel()
+	test := newUDPV5Test(t, Config{})
+	defer test.close()
+
+	remote := test.getNode(test.remotekey, test.remoteaddr).Node()
+	c1 := test.udp.call(remote, &v5wire.Ping{}, v5wire.PongMsg)
+	c2 := test.udp.call(remote, &v5wire.Ping{}, v5wire.PongMsg)
+	test.udp.callDone(c2)
+
+	// The first call is answered. The abandoned call must not be sent.
+	test.waitPacketOut(func(p *v5wire.Ping, addr *net.UDPAddr, _ v5wire.Nonce) {
+		if !bytes.Equal(p.ReqID, c1.reqid) {
+			t.Error("abandoned call was sent")
+		}
+		test.packetIn(&v5wire.Pong{ReqID: p.ReqID})
+	})
+	select {
+	case <-c1.ch:
+	case err := <-c1.err:
+		t.Fatal("call failed:", err)
+	}
+	test.udp.callDone(c1)
+
+	// Calls to the node still work.
+	done := make(chan error, 1)
+	go func() {
+		_, err := test.udp.ping(remote)
+		done <- err
+	}()
+	test.waitPacketOut(func(p *v5wire.Ping, addr *net.UDPAddr, _ v5wire.Nonce) {
+		test.packetIn(&v5wire.Pong{ReqID: p.ReqID})
+	})
+	if err := <-done; err != nil {
+		t.Fatal("ping failed:", err)
+	}
+}
+
 // This test checks that TALKREQ calls the registered handler function.
 func TestUDPv5_talkHandling(t *testing.T) {
 	t.Parallel()
@@ -51,8 +51,11 @@ const (
 	dbNodeSeq       = "seq"
 
 	// Local information is keyed by ID only, the full key is "local:<ID>:seq".
-	// Use localItemKey to create those keys.
-	dbLocalSeq = "seq"
+	// Use localItemKey to create those keys. Topic states are stored with the time
+	// they were written, and are dropped by the expirer when they get too old.
+	dbLocalSeq         = "seq"
+	dbLocalTopicReg    = "topicreg:"    // followed by the topic hash
+	dbLocalTopicSearch = "topicsearch:" // followed by the topic hash
 )
 
 const (
@@ -315,6 +318,7 @@ func (db *DB) expirer() {
 		select {
 		case <-tick.C:
 			db.expireNodes()
+			db.expireTopicStates()
 		case <-db.quit:
 			return
 		}
@@ -442,6 +446,67 @@ func (db *DB) storeLocalSeq(id ID, n uint64) {
 	db.storeUint64(localItemKey(id, dbLocalSeq), n)
 }
 
+// TopicRegState retrieves the stored topic registration state of the local node.
+func (db *DB) TopicRegState(id ID, topic [32]byte) []byte {
+	return db.fetchTopicState(localItemKey(id, dbLocalTopicReg+string(topic[:])))
+}
+
+// StoreTopicRegState stores the topic registration state of the local node.
+func (db *DB) StoreTopicRegState(id ID, topic [32]byte, state []byte) error {
+	return db.storeTopicState(localItemKey(id, dbLocalTopicReg+string(topic[:])), state, time.Now())
+}
+
+// TopicSearchState retrieves the stored topic search state of the local node.
+func (db *DB) TopicSearchState(id ID, topic [32]byte) []byte {
+	return db.fetchTopicState(localItemKey(id, dbLocalTopicSearch+string(topic[:])))
+}
+
+// StoreTopicSearchState stores the topic search state of the local node.
+func (db *DB) StoreTopicSearchState(id ID, topic [32]byte, state []byte) error {
+	return db.storeTopicState(localItemKey(id, dbLocalTopicSearch+string(topic[:])), state, time.Now())
+}
+
+// fetchTopicState retrieves a topic state, stripping the time it was stored.
+func (db *DB) fetchTopicState(key []byte) []byte {
+	blob, err := db.lvl.Get(key, nil)
+	if err != nil {
+		return nil
+	}
+	if _, n := binary.Varint(blob); n > 0 {
+		return blob[n:]
+	}
+	return nil
+}
+
+// storeTopicState stores a topic state, prefixed by the given time.
+func (db *DB) storeTopicState(key []byte, state []byte, now time.Time) error {
+	blob := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(state))
+	blob = append(blob[:binary.PutVarint(blob, now.Unix())], state...)
+	return db.lvl.Put(key, blob, nil)
+}
+
+// expireTopicStates deletes topic registration and search states which haven't
+// been stored for some time.
+func (db *DB) expireTopicStates() {
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(dbLocalPrefix)), nil)
+	defer it.Release()
+
+	threshold := time.Now().Add(-dbNodeExpiration).Unix()
+	for it.Next() {
+		key := it.Key()
+		if len(key) <= len(dbLocalPrefix)+len(ID{}) {
+			continue
+		}
+		field := key[len(dbLocalPrefix)+len(ID{})+1:]
+		if !bytes.HasPrefix(field, []byte(dbLocalTopicReg)) && !bytes.HasPrefix(field, []byte(dbLocalTopicSearch)) {
+			continue
+		}
+		if time, n := binary.Varint(it.Value()); n <= 0 || time < threshold {
+			db.lvl.Delete(key, nil)
+		}
+	}
+}
+
 // QuerySeeds retrieves random nodes to be used as potential seed nodes
 // for bootstrapping.
 func (db *DB) QuerySeeds(n int, maxAge time.Duration) []*Node {
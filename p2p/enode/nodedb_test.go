@@ -467,3 +467,43 @@ func TestDBExpireV5(t *testing.T) {
 	db.UpdateFindFailsV5(ID{}, ip, 4)
 	db.expireNodes()
 }
+
+// This test checks that topic states are dropped by the expirer when they
+// haven't been stored for a while.
+func TestDBExpireTopicState(t *testing.T) {
+	db, _ := OpenDB("")
+	defer db.Close()
+
+	var (
+		id       = ID{1}
+		fresh    = [32]byte{1}
+		old      = [32]byte{2}
+		oldTime  = time.Now().Add(-dbNodeExpiration - time.Minute)
+		oldState = []byte{4, 5, 6}
+	)
+	db.StoreTopicRegState(id, fresh, []byte{1, 2, 3})
+	db.StoreTopicSearchState(id, fresh, []byte{1, 2, 3})
+	db.storeTopicState(localItemKey(id, dbLocalTopicReg+string(old[:])), oldState, oldTime)
+	db.storeTopicState(localItemKey(id, dbLocalTopicSearch+string(old[:])), oldState, oldTime)
+	db.storeLocalSeq(id, 10)
+	if s := db.TopicRegState(id, old); !bytes.Equal(s, oldState) {
+		t.Fatalf("wrong stored state %x", s)
+	}
+
+	db.expireTopicStates()
+	if s := db.TopicRegState(id, fresh); !bytes.Equal(s, []byte{1, 2, 3}) {
+		t.Errorf("fresh registration state removed: %x", s)
+	}
+	if s := db.TopicSearchState(id, fresh); !bytes.Equal(s, []byte{1, 2, 3}) {
+		t.Errorf("fresh search state removed: %x", s)
+	}
+	if s := db.TopicRegState(id, old); s != nil {
+		t.Errorf("old registration state not removed: %x", s)
+	}
+	if s := db.TopicSearchState(id, old); s != nil {
+		t.Errorf("old search state not removed: %x", s)
+	}
+	if seq := db.localSeq(id); seq != 10 {
+		t.Errorf("local seq changed to %d", seq)
+	}
+}